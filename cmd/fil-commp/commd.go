@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+	"github.com/ribasushi/fil-discover-check/commp"
+)
+
+var namedSectorSizes = map[string]uint64{
+	"32GiB": commp.SectorSize32GiB,
+	"64GiB": commp.SectorSize64GiB,
+}
+
+func computeCommD(argv []string) {
+
+	cfg := struct {
+		SectorSize string `getopt:"-s --sector-size=size  Sector size: 32GiB, 64GiB or a number of bytes. Default:"`
+		Help       bool   `getopt:"-h --help              Display help"`
+	}{
+		SectorSize: "32GiB",
+	}
+
+	optSet := getopt.New()
+	if err := options.RegisterSet("", &cfg, optSet); err != nil {
+		log.Fatalf("option set registration failed: %s", err)
+	}
+	optSet.SetProgram(filepath.Base(os.Args[0]) + " commd")
+	optSet.SetParameters("[pieceCID:paddedSize ...]\n\n" +
+		"Computes the unsealed sector CID (CommD) of a sector holding the supplied pieces\n" +
+		"in order. Without arguments pieces are read from stdIN in the format printed by\n" +
+		"fil-commp itself: piece CID, payload size and padded size separated by whitespace\n",
+	)
+
+	usageErr := func(problem string) {
+		fmt.Fprintf(os.Stderr, "\n%s\n\n", problem)
+		optSet.PrintUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	if err := optSet.Getopt(argv, nil); err != nil {
+		usageErr(err.Error())
+	}
+	if cfg.Help {
+		optSet.PrintUsage(os.Stdout)
+		return
+	}
+
+	sectorSize, named := namedSectorSizes[cfg.SectorSize]
+	if !named {
+		var err error
+		if sectorSize, err = strconv.ParseUint(cfg.SectorSize, 10, 64); err != nil {
+			usageErr(fmt.Sprintf("Invalid sector size '%s'", cfg.SectorSize))
+		}
+	}
+
+	var pieces []commp.PieceInfo
+	if optSet.NArgs() > 0 {
+		for _, arg := range optSet.Args() {
+			sep := strings.LastIndexByte(arg, ':')
+			if sep < 0 {
+				usageErr(fmt.Sprintf("Invalid piece '%s', expecting pieceCID:paddedSize", arg))
+			}
+			p, err := parsePiece(arg[:sep], arg[sep+1:])
+			if err != nil {
+				usageErr(fmt.Sprintf("Invalid piece '%s': %s", arg, err))
+			}
+			pieces = append(pieces, p)
+		}
+	} else {
+		var err error
+		if pieces, err = readPieces(os.Stdin); err != nil {
+			log.Fatalf("Reading pieces from stdIN failed: %s", err)
+		}
+	}
+
+	commD, err := commp.UnsealedSectorCID(sectorSize, pieces)
+	if err != nil {
+		log.Fatalf("Computing CommD failed: %s", err)
+	}
+
+	fmt.Println(commD)
+}
+
+func readPieces(r io.Reader) (pieces []commp.PieceInfo, err error) {
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected at least 3 fields, found %d", lineNum, len(fields))
+		}
+		p, err := parsePiece(fields[0], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNum, err)
+		}
+		pieces = append(pieces, p)
+	}
+	return pieces, s.Err()
+}
+
+func parsePiece(cidStr, sizeStr string) (p commp.PieceInfo, err error) {
+	if p.PieceCID, err = cid.Parse(cidStr); err != nil {
+		return p, fmt.Errorf("undecodeable piece CID: %s", err)
+	}
+	if p.Size, err = strconv.ParseUint(sizeStr, 10, 64); err != nil {
+		return p, fmt.Errorf("invalid padded size '%s'", sizeStr)
+	}
+	return p, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+	"github.com/ribasushi/fil-discover-check/fr32"
+	"github.com/ribasushi/fil-discover-check/internal/util/stream"
+)
+
+func convertFr32(argv []string) {
+
+	cfg := struct {
+		Unpad       bool   `getopt:"-u --unpad                 Unpad instead of padding"`
+		PayloadSize int64  `getopt:"--payload-size=bytes       With --unpad: truncate the output to the original payload size, dropping the zero-filled tail of the last quantum"`
+		Output      string `getopt:"-o --output=file           Write to the given file instead of stdOUT"`
+		Help        bool   `getopt:"-h --help                  Display help"`
+	}{}
+
+	optSet := getopt.New()
+	if err := options.RegisterSet("", &cfg, optSet); err != nil {
+		log.Fatalf("option set registration failed: %s", err)
+	}
+	optSet.SetProgram(filepath.Base(os.Args[0]) + " fr32")
+	optSet.SetParameters("[file]\n\n" +
+		"Converts a payload into its fr32 expansion, the exact bytes a piece consists of\n" +
+		"before sealing, or with --unpad converts an expansion back. A trailing partial\n" +
+		"quantum of the payload is zero-filled. Without a file argument the data is read\n" +
+		"from stdIN\n",
+	)
+
+	usageErr := func(problem string) {
+		fmt.Fprintf(os.Stderr, "\n%s\n\n", problem)
+		optSet.PrintUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	if err := optSet.Getopt(argv, nil); err != nil {
+		usageErr(err.Error())
+	}
+	if cfg.Help {
+		optSet.PrintUsage(os.Stdout)
+		return
+	}
+	if optSet.NArgs() > 1 {
+		usageErr("At most one input file can be supplied")
+	}
+	if optSet.IsSet("payload-size") && (!cfg.Unpad || cfg.PayloadSize < 0) {
+		usageErr("--payload-size requires --unpad and a non-negative size")
+	}
+
+	in := io.Reader(os.Stdin)
+	if optSet.NArgs() == 1 {
+		fh, err := os.Open(optSet.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fh.Close()
+		in = fh
+	} else if stream.IsTTY(os.Stdin) {
+		log.Fatal("Refusing to read a stream from a terminal: supply a file name or redirect stdIN")
+	}
+
+	outFh := os.Stdout
+	if cfg.Output != "" {
+		var err error
+		if outFh, err = os.Create(cfg.Output); err != nil {
+			log.Fatal(err)
+		}
+	} else if stream.IsTTY(os.Stdout) {
+		log.Fatal("Refusing to write binary data to a terminal: supply --output or redirect stdOUT")
+	}
+	out := bufio.NewWriter(outFh)
+
+	var err error
+	if cfg.Unpad {
+		r := fr32.NewUnpadReader(in)
+		if optSet.IsSet("payload-size") {
+			var n int64
+			n, err = io.Copy(out, io.LimitReader(r, cfg.PayloadSize))
+			if err == nil && n < cfg.PayloadSize {
+				err = fmt.Errorf("unpadded data of %d bytes is shorter than the payload size %d", n, cfg.PayloadSize)
+			}
+		} else {
+			_, err = io.Copy(out, r)
+		}
+	} else {
+		w := fr32.NewPadWriter(out)
+		if _, err = io.Copy(w, in); err == nil {
+			err = w.Close()
+		}
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = outFh.Close()
+	}
+	if err != nil {
+		log.Fatalf("Conversion failed: %s", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ribasushi/fil-discover-check/dagger"
+	"github.com/ribasushi/fil-discover-check/internal/util/stream"
+)
+
+// Prepended to argv unless overridden by the user: compute commP, and keep
+// stdOUT for the piece listing below
+var defaultArgs = []struct{ prefix, arg string }{
+	{"--collectors", "--collectors=fil-commP"},
+	{"--emit-stdout", "--emit-stdout=none"},
+}
+
+func main() {
+
+	log.SetFlags(0)
+	log.SetPrefix("fil-commp: ")
+
+	if len(os.Args) > 1 && os.Args[1] == "commd" {
+		computeCommD(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fr32" {
+		convertFr32(os.Args[1:])
+		return
+	}
+
+	argv := []string{os.Args[0]}
+	for _, da := range defaultArgs {
+		if !argvHasOption(os.Args[1:], da.prefix) {
+			argv = append(argv, da.arg)
+		}
+	}
+	argv = append(argv, os.Args[1:]...)
+
+	dgr, inputs, err := dagger.NewFromArgvWithInputs(
+		argv,
+		"[file ...]\n\n"+
+			"Prints the piece CID, payload size and padded piece size of every file (or every\n"+
+			"substream in --multipart mode), tab-separated. Without file arguments the stream\n"+
+			"is read from stdIN. With --collectors=fil-commP_retain-tree=level the tree of\n"+
+			"every file is additionally written to a <file>.commp-tree sidecar\n\n"+
+			"Use 'commd --help' for computing the unsealed CID of a sector holding several pieces\n"+
+			"Use 'fr32 --help' for fr32-padding a file, or unpadding it\n",
+	)
+	if err != nil {
+		if argvErr, isArgvErr := err.(*dagger.ArgvError); isArgvErr {
+			argvErr.PrintUsage(os.Stderr)
+			os.Exit(argvErr.ExitCode())
+		}
+		log.Fatal(err)
+	}
+	defer dgr.Destroy()
+
+	out := bufio.NewWriter(os.Stdout)
+
+	if len(inputs) == 0 {
+		if stream.IsTTY(os.Stdin) {
+			log.Fatal("Refusing to read a stream from a terminal: supply file names or redirect stdIN")
+		}
+		inputs = []string{"-"}
+	}
+
+	var failed int
+	for _, name := range inputs {
+		if err := processInput(dgr, name, out); err != nil {
+			log.Printf("Processing '%s' failed: %s", name, err)
+			failed++
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		log.Fatalf("Writing results failed: %s", err)
+	}
+
+	if failed > 0 {
+		dgr.Destroy()
+		os.Exit(1)
+	}
+}
+
+func processInput(dgr *dagger.Dagger, name string, out *bufio.Writer) error {
+
+	fh := os.Stdin
+	if name != "-" {
+		var err error
+		if fh, err = os.Open(name); err != nil {
+			return err
+		}
+		defer fh.Close()
+	}
+
+	stat, err := fh.Stat()
+
+	// regular files are hashed in parallel segments whenever the configuration allows it
+	var results []*dagger.Result
+	if err == nil && stat.Mode().IsRegular() && stat.Size() > 0 {
+		var res *dagger.Result
+		res, err = dgr.ProcessReaderAt(fh, stat.Size())
+		if err == nil {
+			results = []*dagger.Result{res}
+		} else if err != dagger.ErrReaderAtUnsupported {
+			return err
+		}
+	}
+
+	if results == nil {
+		// read hints are entirely opportunistic: failures are of no consequence
+		if stat != nil {
+			for _, opt := range stream.ReadOptimizations {
+				opt.Action(fh, stat) // nolint:errcheck
+			}
+		}
+
+		if results, err = dgr.ProcessReader(fh); err != nil {
+			return err
+		}
+	}
+
+	if len(results) == 0 {
+		return errors.New("no data: an empty stream has no piece commitment")
+	}
+
+	for _, res := range results {
+		source := name
+		if res.Substream > 0 {
+			source = fmt.Sprintf("%s#%d", name, res.Substream)
+		}
+		fmt.Fprintf(out, "%s\t%d\t%d\t%s\n", res.Cid, res.PayloadSize, res.PaddedPieceSize, source)
+
+		if res.PieceTree != nil {
+			if err := writeTreeSidecar(name, res); err != nil {
+				return err
+			}
+		}
+	}
+
+	// every input is an independent run as far as the stats are concerned
+	return dgr.OutputSummary()
+}
+
+// writeTreeSidecar stores the retained tree next to the input file, as
+// <file>.commp-tree or <file>.<substream>.commp-tree in --multipart mode
+func writeTreeSidecar(name string, res *dagger.Result) error {
+
+	if name == "-" {
+		log.Printf("Not writing a tree sidecar for stdIN")
+		return nil
+	}
+
+	sidecar := name
+	if res.Substream > 0 {
+		sidecar = fmt.Sprintf("%s.%d", sidecar, res.Substream)
+	}
+	sidecar += ".commp-tree"
+
+	fh, err := os.Create(sidecar)
+	if err != nil {
+		return err
+	}
+	if _, err := res.PieceTree.WriteTo(fh); err != nil {
+		fh.Close()
+		return fmt.Errorf("writing tree sidecar '%s' failed: %s", sidecar, err)
+	}
+	return fh.Close()
+}
+
+func argvHasOption(args []string, option string) bool {
+	for _, a := range args {
+		if a == "--" {
+			break
+		}
+		if a == option || strings.HasPrefix(a, option+"=") {
+			return true
+		}
+	}
+	return false
+}
@@ -1,15 +1,65 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 
 	rice "github.com/GeertJohan/go.rice"
+	sha256simd "github.com/minio/sha256-simd"
 )
 
 const knownCarCount = 4159209
 
-var dataSets = map[uint8]string{
+// The index file comes in two flavors:
+//
+// Legacy: a headerless sequence of v1 car records
+//
+// Current:
+//
+//	8 bytes    magic "FDCINDEX"
+//	1 byte     format version: determines the car record layout
+//	uint16BE   count of dataset descriptions, each consisting of:
+//	             uint8     dataset ID
+//	             uint32BE  expected amount of CARs in the dataset
+//	             3 x       uint16BE-length-prefixed UTF-8 strings: name, description, owner
+//	the remainder of the file is a sequence of car records
+//
+// Each v1 car record is 37 bytes:
+//
+//	16 bytes   the lower 16 bytes of the payload CID
+//	uint8      dataset ID
+//	uint32BE   expected size of the .car file
+//	16 bytes   the lower 16 bytes of the commP
+//
+// Each v2 car record is 41 bytes, identical to v1 except for the size:
+//
+//	16 bytes   the lower 16 bytes of the payload CID
+//	uint8      dataset ID
+//	uint64BE   expected size of the .car file
+//	16 bytes   the lower 16 bytes of the commP
+const (
+	indexMagic         = "FDCINDEX"
+	indexLatestVersion = 2
+)
+
+var indexRecordLen = map[byte]int{
+	1: 37,
+	2: 41,
+}
+
+// legacyDataSets is the registry assumed for legacy headerless index files,
+// which do not carry one of their own
+var legacyDataSets = map[uint8]string{
 	10: "dumbo-stage3-datasets.elasticmapreduce",
 	27: "dumbo-stage3-fast-ai-nlp",
 	29: "dumbo-stage3-gdelt-open-data",
@@ -41,13 +91,29 @@ var dataSets = map[uint8]string{
 	22: "dumbo-v2-cars-source-wikipedia",
 }
 
+type dataSet struct {
+	ID           uint8
+	Name         string
+	Description  string `json:",omitempty"`
+	Owner        string `json:",omitempty"`
+	ExpectedCars uint32
+}
+
 type carData struct {
 	datasetID    uint8
-	expectedSize uint32
+	expectedSize uint64
 	commP        [16]byte
 }
 
-var knownCars = make(map[[16]byte]carData, knownCarCount)
+type index struct {
+	datasets map[uint8]*dataSet
+	cars     map[[16]byte]carData
+}
+
+var dataSets map[uint8]*dataSet
+var knownCars map[[16]byte]carData
+
+var patchFileName = regexp.MustCompile(`\Afil_discover_patch_.+\.dat\z`)
 
 func loadDatasetDescriptions() {
 
@@ -58,16 +124,279 @@ func loadDatasetDescriptions() {
 		log.Fatalf("unable to read list of known dumbo cars: %s", err)
 	}
 
-	var i int
-	var key, commP [16]byte
-	for i < len(d) {
-		copy(key[:], d[i:i+16])
-		copy(commP[:], d[i+21:i+37])
-		knownCars[key] = carData{
-			datasetID:    d[i+16],
-			expectedSize: binary.BigEndian.Uint32(d[i+17 : i+21]),
-			commP:        commP,
+	idx, err := parseIndex(d)
+	if err != nil {
+		log.Fatalf("unable to parse list of known dumbo cars: %s", err)
+	}
+
+	// any patches shipped alongside the full index, or placed in the directory
+	// of the executable, are applied in filename order: the latter allow
+	// corrections to reach a machine without a rebuild, and take precedence
+	// over an embedded patch of the same name
+	patchSources := make(map[string]func() ([]byte, error))
+	if err := DataBox.Walk("", func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name := filepath.Base(path); fi.Mode().IsRegular() && patchFileName.MatchString(name) {
+			patchSources[name] = func() ([]byte, error) { return DataBox.Bytes(name) }
+		}
+		return nil
+	}); err != nil {
+		log.Fatalf("unable to list index patches: %s", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("unable to locate the executable: %s", err)
+	}
+	exeDir := filepath.Dir(exe)
+	entries, err := ioutil.ReadDir(exeDir)
+	if err != nil {
+		log.Fatalf("unable to list index patches in %s: %s", exeDir, err)
+	}
+	for _, fi := range entries {
+		if path := filepath.Join(exeDir, fi.Name()); fi.Mode().IsRegular() && patchFileName.MatchString(fi.Name()) {
+			patchSources[fi.Name()] = func() ([]byte, error) { return ioutil.ReadFile(path) }
+		}
+	}
+
+	patchNames := make([]string, 0, len(patchSources))
+	for pn := range patchSources {
+		patchNames = append(patchNames, pn)
+	}
+	sort.Strings(patchNames)
+
+	patches := make([]*indexPatch, 0, len(patchNames))
+	for _, pn := range patchNames {
+		d, err := patchSources[pn]()
+		if err != nil {
+			log.Fatalf("unable to read index patch '%s': %s", pn, err)
+		}
+		p, err := parsePatch(d)
+		if err != nil {
+			log.Fatalf("unable to parse index patch '%s': %s", pn, err)
 		}
-		i += 37
+		patches = append(patches, p)
+	}
+
+	if err := applyPatchChain(idx, patches); err != nil {
+		log.Fatalf("unable to patch list of known dumbo cars with %s: %s", strings.Join(patchNames, ", "), err)
+	}
+
+	dataSets = idx.datasets
+	knownCars = idx.cars
+}
+
+// datasetName returns the registered name of a dataset, or an explicit
+// placeholder for IDs not present in the registry
+func datasetName(id uint8) (name string, registered bool) {
+	if ds, exists := dataSets[id]; exists {
+		return ds.Name, true
+	}
+	return fmt.Sprintf("UNREGISTERED-DATASET-%d", id), false
+}
+
+func parseIndex(d []byte) (*index, error) {
+
+	idx := &index{
+		datasets: make(map[uint8]*dataSet),
+		cars:     make(map[[16]byte]carData, knownCarCount),
+	}
+
+	if len(d) < len(indexMagic) || string(d[:len(indexMagic)]) != indexMagic {
+		// legacy headerless file: fall back to the registry it was shipped with
+		for id, name := range legacyDataSets {
+			idx.datasets[id] = &dataSet{ID: id, Name: name}
+		}
+		return idx, idx.parseRecords(d, 1)
+	}
+
+	d = d[len(indexMagic):]
+	if len(d) < 3 {
+		return nil, errors.New("truncated index header")
+	}
+	version := d[0]
+	if _, known := indexRecordLen[version]; !known {
+		return nil, fmt.Errorf("unsupported index format version %d", version)
+	}
+
+	dsCount := int(binary.BigEndian.Uint16(d[1:3]))
+	d = d[3:]
+
+	for dsCount > 0 {
+		dsCount--
+
+		var ds *dataSet
+		var err error
+		if ds, d, err = parseDataset(d); err != nil {
+			return nil, err
+		}
+
+		if _, exists := idx.datasets[ds.ID]; exists {
+			return nil, fmt.Errorf("dataset #%d described more than once", ds.ID)
+		}
+		idx.datasets[ds.ID] = ds
+	}
+
+	return idx, idx.parseRecords(d, version)
+}
+
+func (idx *index) parseRecords(d []byte, version byte) error {
+
+	recLen := indexRecordLen[version]
+	if len(d)%recLen != 0 {
+		return fmt.Errorf(
+			"car record section of %d bytes is not a multiple of the %d-byte v%d record size",
+			len(d),
+			recLen,
+			version,
+		)
+	}
+
+	for i := 0; i < len(d); i += recLen {
+		key, cd := parseRecord(d[i:i+recLen], version)
+		idx.cars[key] = cd
+	}
+
+	return nil
+}
+
+func parseDataset(d []byte) (ds *dataSet, remainder []byte, err error) {
+
+	if len(d) < 5 {
+		return nil, nil, errors.New("truncated dataset description")
+	}
+	ds = &dataSet{
+		ID:           d[0],
+		ExpectedCars: binary.BigEndian.Uint32(d[1:5]),
+	}
+	d = d[5:]
+
+	for _, s := range []*string{&ds.Name, &ds.Description, &ds.Owner} {
+		if len(d) < 2 {
+			return nil, nil, fmt.Errorf("truncated description of dataset #%d", ds.ID)
+		}
+		l := int(binary.BigEndian.Uint16(d[:2]))
+		if len(d) < 2+l {
+			return nil, nil, fmt.Errorf("truncated description of dataset #%d", ds.ID)
+		}
+		*s = string(d[2 : 2+l])
+		d = d[2+l:]
+	}
+
+	return ds, d, nil
+}
+
+func parseRecord(rec []byte, version byte) (key [16]byte, cd carData) {
+
+	if version == 1 {
+		cd.expectedSize = uint64(binary.BigEndian.Uint32(rec[17:21]))
+	} else {
+		cd.expectedSize = binary.BigEndian.Uint64(rec[17:25])
+	}
+
+	copy(key[:], rec[:16])
+	cd.datasetID = rec[16]
+	copy(cd.commP[:], rec[len(rec)-16:])
+	return
+}
+
+func appendDataset(buf []byte, ds *dataSet) []byte {
+	buf = append(buf, ds.ID, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], ds.ExpectedCars)
+	for _, s := range []string{ds.Name, ds.Description, ds.Owner} {
+		buf = append(buf, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(len(s)))
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+// appendRecord always produces a record in the latest (v2) layout
+func appendRecord(buf []byte, key [16]byte, cd carData) []byte {
+	buf = append(buf, key[:]...)
+	buf = append(buf, cd.datasetID, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(buf[len(buf)-8:], cd.expectedSize)
+	return append(buf, cd.commP[:]...)
+}
+
+// recordsDigest is the order-independent digest of a set of car records: the
+// sum modulo 2^256 of the sha256 of every record in the v2 layout. Unlike a
+// hash over a sorted serialization it is computed in a single pass without
+// buffering, and is updated in place as records are added or removed.
+type recordsDigest [4]uint64
+
+func carRecordHash(key [16]byte, cd carData) [4]uint64 {
+	var buf [41]byte
+	h := sha256simd.Sum256(appendRecord(buf[:0], key, cd))
+	return [4]uint64{
+		binary.BigEndian.Uint64(h[0:8]),
+		binary.BigEndian.Uint64(h[8:16]),
+		binary.BigEndian.Uint64(h[16:24]),
+		binary.BigEndian.Uint64(h[24:32]),
+	}
+}
+
+func (rd *recordsDigest) add(key [16]byte, cd carData) {
+	h := carRecordHash(key, cd)
+	var carry uint64
+	for i := 3; i >= 0; i-- {
+		rd[i], carry = bits.Add64(rd[i], h[i], carry)
+	}
+}
+
+func (rd *recordsDigest) remove(key [16]byte, cd carData) {
+	h := carRecordHash(key, cd)
+	var borrow uint64
+	for i := 3; i >= 0; i-- {
+		rd[i], borrow = bits.Sub64(rd[i], h[i], borrow)
+	}
+}
+
+func (idx *index) recordsDigest() (rd recordsDigest) {
+	for k, cd := range idx.cars {
+		rd.add(k, cd)
+	}
+	return
+}
+
+// contentHash identifies the contents of an index regardless of the format
+// version or record order it was originally stored in: the sha256 of the
+// datasets in ascending order, followed by the digest of the car records
+func (idx *index) contentHash(rd recordsDigest) [32]byte {
+	h := sha256simd.New()
+	var buf []byte
+	for _, id := range sortedDatasetIDs(idx) {
+		buf = appendDataset(buf, idx.datasets[id])
+	}
+	for _, limb := range rd {
+		buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], limb)
+	}
+	h.Write(buf)
+
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func sortedDatasetIDs(idx *index) []uint8 {
+	ids := make([]uint8, 0, len(idx.datasets))
+	for id := range idx.datasets {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func sortedCarKeys(idx *index) [][16]byte {
+	keys := make([][16]byte, 0, len(idx.cars))
+	for k := range idx.cars {
+		keys = append(keys, k)
 	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i][:], keys[j][:]) < 0
+	})
+	return keys
 }
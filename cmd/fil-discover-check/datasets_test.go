@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// indexHeader produces the header of a current index file
+func indexHeader(version byte, datasets ...*dataSet) []byte {
+	d := append([]byte(indexMagic), version, 0, 0)
+	binary.BigEndian.PutUint16(d[len(d)-2:], uint16(len(datasets)))
+	for _, ds := range datasets {
+		d = appendDataset(d, ds)
+	}
+	return d
+}
+
+// appendV1Record produces a car record in the 37-byte v1 layout
+func appendV1Record(buf []byte, key [16]byte, cd carData) []byte {
+	buf = append(buf, key[:]...)
+	buf = append(buf, cd.datasetID, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(cd.expectedSize))
+	return append(buf, cd.commP[:]...)
+}
+
+var testCars = map[[16]byte]carData{
+	{1}: {datasetID: 2, expectedSize: 100, commP: [16]byte{0xa}},
+	{2}: {datasetID: 3, expectedSize: 1<<32 - 1, commP: [16]byte{0xb}},
+}
+
+func TestParseLegacyIndex(t *testing.T) {
+
+	var d []byte
+	for k, cd := range testCars {
+		d = appendV1Record(d, k, cd)
+	}
+
+	idx, err := parseIndex(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.cars) != len(testCars) || idx.cars[[16]byte{2}] != testCars[[16]byte{2}] {
+		t.Errorf("unexpected records %v", idx.cars)
+	}
+	if len(idx.datasets) != len(legacyDataSets) || idx.datasets[2].Name != legacyDataSets[2] {
+		t.Errorf("legacy file not given the fallback registry: %v", idx.datasets)
+	}
+}
+
+func TestParseIndexVersions(t *testing.T) {
+
+	datasets := []*dataSet{
+		{ID: 2, Name: "two", Description: "the second", Owner: "someone", ExpectedCars: 1},
+		{ID: 3, Name: "three", ExpectedCars: 1},
+	}
+
+	v1 := indexHeader(1, datasets...)
+	for k, cd := range testCars {
+		v1 = appendV1Record(v1, k, cd)
+	}
+
+	// v2 carries sizes past the 4GiB limit of v1
+	large := map[[16]byte]carData{{3}: {datasetID: 3, expectedSize: 5 << 30, commP: [16]byte{0xc}}}
+	v2 := indexHeader(2, datasets...)
+	for _, cars := range []map[[16]byte]carData{testCars, large} {
+		for k, cd := range cars {
+			v2 = appendRecord(v2, k, cd)
+		}
+	}
+
+	for version, tc := range map[int]struct {
+		d    []byte
+		cars int
+	}{
+		1: {v1, 2},
+		2: {v2, 3},
+	} {
+		idx, err := parseIndex(tc.d)
+		if err != nil {
+			t.Fatalf("v%d: %s", version, err)
+		}
+		if len(idx.cars) != tc.cars || idx.cars[[16]byte{1}] != testCars[[16]byte{1}] || idx.cars[[16]byte{2}] != testCars[[16]byte{2}] {
+			t.Errorf("v%d: unexpected records %v", version, idx.cars)
+		}
+		if len(idx.datasets) != 2 || *idx.datasets[2] != *datasets[0] || *idx.datasets[3] != *datasets[1] {
+			t.Errorf("v%d: unexpected datasets %v", version, idx.datasets)
+		}
+	}
+
+	if idx, _ := parseIndex(v2); idx.cars[[16]byte{3}].expectedSize != 5<<30 {
+		t.Errorf("v2 size of %d bytes instead of %d", idx.cars[[16]byte{3}].expectedSize, uint64(5<<30))
+	}
+}
+
+func TestParseIndexMalformed(t *testing.T) {
+
+	ds := &dataSet{ID: 2, Name: "two"}
+	header := indexHeader(2, ds)
+	record := appendRecord(nil, [16]byte{1}, carData{datasetID: 2})
+
+	for name, tc := range map[string]struct {
+		d       []byte
+		errText string
+	}{
+		"truncated header":              {[]byte(indexMagic + "\x02\x00"), "truncated index header"},
+		"unknown version":               {indexHeader(9), "unsupported index format version 9"},
+		"missing dataset description":   {indexHeader(2, ds)[:len(indexMagic)+3], "truncated dataset description"},
+		"truncated dataset description": {header[:len(header)-1], "truncated description of dataset #2"},
+		"duplicate dataset ID":          {indexHeader(2, ds, &dataSet{ID: 2, Name: "again"}), "dataset #2 described more than once"},
+		"partial v2 record":             {append(append([]byte{}, header...), record[:40]...), "not a multiple of the 41-byte v2 record size"},
+		"v2 record in a v1 file":        {append(indexHeader(1, ds), record...), "not a multiple of the 37-byte v1 record size"},
+		"partial record in legacy file": {make([]byte, 36), "not a multiple of the 37-byte v1 record size"},
+		"trailing byte after v2 record": {append(append(append([]byte{}, header...), record...), 0), "not a multiple"},
+	} {
+		_, err := parseIndex(tc.d)
+		if err == nil || !strings.Contains(err.Error(), tc.errText) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, tc.errText, err)
+		}
+	}
+}
@@ -21,9 +21,10 @@ import (
 	"github.com/cheggaaa/pb/v3"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-car"
+	sha256simd "github.com/minio/sha256-simd"
 	"github.com/pborman/getopt/v2"
 	"github.com/pborman/options"
-	"github.com/ribasushi/fil-discover-check/internal/dagger"
+	"github.com/ribasushi/fil-discover-check/dagger"
 	"github.com/ribasushi/fil-discover-check/internal/dagger/util/argparser"
 	"github.com/segmentio/ksuid"
 	"golang.org/x/sys/unix"
@@ -42,14 +43,24 @@ type stats struct {
 	SoftFailures       int
 	HardFailures       int
 	Flawless           int
+	DuplicateFiles     int
 	CarfilesPerDataset map[string]int
 	Carfiles           map[string]*carInfo
+	Duplicates         duplicates
+}
+
+type duplicates struct {
+	// payload CID => paths of every additional copy beyond the one in Carfiles
+	Payloads map[string][]string
+	// groups of byte-identical files named after different payload CIDs
+	IdenticalContent [][]string
 }
 
 type DumboChecker struct {
 	stats
 	cfg       config
 	drivePath string
+	commpPool *dagger.Pool
 }
 
 type carInfo struct {
@@ -58,8 +69,10 @@ type carInfo struct {
 	ByteSize  int64
 
 	ByteSizeValidated  bool
-	CarHeaderValidated bool `json:",omitempty"`
-	CommpValidated     bool `json:",omitempty"`
+	CarHeaderValidated bool   `json:",omitempty"`
+	CommpValidated     bool   `json:",omitempty"`
+	PieceCid           string `json:",omitempty"`
+	PaddedPieceSize    uint64 `json:",omitempty"`
 
 	SoftFails []string
 	HardFails []string
@@ -69,6 +82,16 @@ type carInfo struct {
 
 func main() {
 
+	if len(os.Args) > 1 {
+		if sc, exists := subcommands[os.Args[1]]; exists {
+			if !sc.standalone {
+				loadDatasetDescriptions()
+			}
+			sc.run(os.Args[1:])
+			return
+		}
+	}
+
 	loadDatasetDescriptions()
 
 	if runtime.GOOS != "linux" {
@@ -114,6 +137,14 @@ func main() {
 				SoftFails: make([]string, 0),
 				HardFails: make([]string, 0),
 			}
+
+			if _, seen := dc.Carfiles[cid.String()]; seen {
+				dc.Duplicates.Payloads[cid.String()] = append(dc.Duplicates.Payloads[cid.String()], ci.FullPath)
+				dc.DuplicateFiles++
+				bar.Increment()
+				return nil
+			}
+
 			copy(ci.key[:], cid.Bytes()[len(cid.Bytes())-16:])
 
 			known, exists := knownCars[ci.key]
@@ -122,8 +153,11 @@ func main() {
 				ci.HardFails = append(ci.HardFails, "payload not found in the Filecoin Discover set")
 			} else {
 				ci.DatasetID = known.datasetID
-				dc.CarfilesPerDataset[dataSets[known.datasetID]] = dc.CarfilesPerDataset[dataSets[known.datasetID]] + 1
-				if int64(known.expectedSize) == ci.ByteSize {
+				// registry gaps are a problem of the index, not of the car: they
+				// surface as UNREGISTERED-DATASET-N in the per-dataset counts
+				dsName, _ := datasetName(known.datasetID)
+				dc.CarfilesPerDataset[dsName] = dc.CarfilesPerDataset[dsName] + 1
+				if known.expectedSize == uint64(ci.ByteSize) {
 					ci.ByteSizeValidated = true
 				} else {
 					ci.SoftFails = append(ci.HardFails, "car file size does not match expected dynamo value")
@@ -141,11 +175,35 @@ func main() {
 
 	log.Printf("Found total of %d car files", len(dc.Carfiles))
 
+	if dc.DuplicateFiles > 0 {
+		log.Printf("Found %d additional copies of %d payloads", dc.DuplicateFiles, len(dc.Duplicates.Payloads))
+	}
+
+	dc.findIdenticalContent()
+
 	for _, k := range MapKeysList(dc.CarfilesPerDataset) {
 		log.Printf("\t%d\tbelong to dataset\t%s\n", dc.CarfilesPerDataset[k], k)
 	}
 
-	bar = pb.Full.Start(len(dc.Carfiles)).SetRefreshRate(5 * time.Second)
+	var totalBytes int64
+	for _, ci := range dc.Carfiles {
+		totalBytes += ci.ByteSize
+	}
+	bar = pb.Full.Start64(totalBytes).Set(pb.Bytes, true).SetRefreshRate(5 * time.Second)
+
+	// the sole commP worker advances the bar as it goes through a file
+	var commpReported int64
+	commpOpts := dagger.DefaultOptions()
+	commpOpts.Collectors = []dagger.CollectorConfig{dagger.FilCommPCollector{}}
+	commpOpts.Progress = func(processed, _ int64) {
+		bar.Add64(processed - commpReported)
+		commpReported = processed
+	}
+	var err error
+	if dc.commpPool, err = dagger.NewPool(commpOpts); err != nil {
+		log.Fatalf("commP calculator initialization failed: %s", err)
+	}
+	defer dc.commpPool.Destroy()
 
 	commpQueue := make(chan string, 20000)
 	spotCheckQueue := make(chan string, 20000)
@@ -179,8 +237,9 @@ func main() {
 				return
 			}
 
+			commpReported = 0
 			dc.Carfiles[key].CommpValidated = dc.validateCommP(key)
-			bar.Increment()
+			bar.Add64(dc.Carfiles[key].ByteSize - commpReported)
 			wg.Done()
 		}
 	}()
@@ -195,7 +254,7 @@ func main() {
 					return
 				}
 				dc.Carfiles[key].CarHeaderValidated = dc.validateCarStructure(key)
-				bar.Increment()
+				bar.Add64(dc.Carfiles[key].ByteSize)
 				wg.Done()
 			}
 		}()
@@ -257,7 +316,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if dc.Flawless > 6900 && dc.CarfilesPerDataset["UNKNOWN"] == 0 {
+	if dc.Flawless > 6900 && dc.CarfilesPerDataset["UNKNOWN"] == 0 && dc.DuplicateFiles == 0 {
 		log.Printf(`
 
 === <3 === <3 === <3 === <3 === <3 === <3 === <3 === <3 === <3 === <3 ===
@@ -284,6 +343,73 @@ Drive %s with %d CARs is GOOD to ship!
 	}
 }
 
+// findIdenticalContent looks for files with the same contents but named
+// after different payloads. Only files of identical size are hashed, which
+// is a rare occurrence on a healthy drive.
+func (dc *DumboChecker) findIdenticalContent() {
+
+	bySize := make(map[int64][]string)
+	for key, ci := range dc.Carfiles {
+		bySize[ci.ByteSize] = append(bySize[ci.ByteSize], key)
+	}
+
+	var candidates int
+	for _, keys := range bySize {
+		if len(keys) > 1 {
+			candidates += len(keys)
+		}
+	}
+	if candidates == 0 {
+		return
+	}
+
+	log.Printf("Comparing contents of %d car files sharing identical sizes...", candidates)
+
+	for _, keys := range bySize {
+		if len(keys) < 2 {
+			continue
+		}
+
+		byHash := make(map[[32]byte][]string, len(keys))
+		for _, key := range keys {
+			carInfo := dc.Carfiles[key]
+
+			carHandle, err := os.Open(dc.drivePath + "/" + carInfo.FullPath)
+			if err != nil {
+				carInfo.HardFails = append(carInfo.HardFails, fmt.Sprintf("unable to open car file for reading: %s", err))
+				continue
+			}
+
+			var digest [32]byte
+			h := sha256simd.New()
+			_, err = io.Copy(h, bufio.NewReaderSize(carHandle, 16<<20))
+			carHandle.Close()
+			if err != nil {
+				carInfo.HardFails = append(carInfo.HardFails, fmt.Sprintf("reading car file for content comparison failed: %s", err))
+				continue
+			}
+
+			copy(digest[:], h.Sum(nil))
+			byHash[digest] = append(byHash[digest], carInfo.FullPath)
+		}
+
+		for _, paths := range byHash {
+			if len(paths) > 1 {
+				sort.Strings(paths)
+				dc.Duplicates.IdenticalContent = append(dc.Duplicates.IdenticalContent, paths)
+				dc.DuplicateFiles += len(paths) - 1
+			}
+		}
+	}
+
+	if len(dc.Duplicates.IdenticalContent) > 0 {
+		sort.Slice(dc.Duplicates.IdenticalContent, func(i, j int) bool {
+			return dc.Duplicates.IdenticalContent[i][0] < dc.Duplicates.IdenticalContent[j][0]
+		})
+		log.Printf("Found %d groups of byte-identical car files with differing names", len(dc.Duplicates.IdenticalContent))
+	}
+}
+
 func (dc *DumboChecker) validateCommP(cidString string) (ok bool) {
 
 	carInfo := dc.Carfiles[cidString]
@@ -295,14 +421,21 @@ func (dc *DumboChecker) validateCommP(cidString string) (ok bool) {
 		return
 	}
 
-	dgr := dagger.NewFromArgv([]string{"welp", "--collectors=fil-commP"})
-	commP, err := dgr.ProcessReader(carHandle)
+	// deliberately a single sequential read: the drives being checked are
+	// spinning disks, where ProcessReaderAt() concurrently seeking across
+	// segments is much slower
+	results, err := dc.commpPool.ProcessReader(carHandle)
 
 	if err != nil {
 		carInfo.HardFails = append(carInfo.HardFails, fmt.Sprintf("commP calculation failed: %s", err))
 		return
 	}
+	res := results[0]
+
+	carInfo.PieceCid = res.Cid.String()
+	carInfo.PaddedPieceSize = res.PaddedPieceSize
 
+	commP := res.Cid.Bytes()
 	known := knownCars[carInfo.key].commP
 	if bytes.Equal(commP[len(commP)-16:], known[:]) {
 		return true
@@ -449,6 +582,10 @@ func NewFromArgs(argv []string) (dc *DumboChecker) {
 		stats: stats{
 			CarfilesPerDataset: make(map[string]int, 8),
 			Carfiles:           make(map[string]*carInfo, 8000),
+			Duplicates: duplicates{
+				Payloads:         make(map[string][]string),
+				IdenticalContent: make([][]string, 0),
+			},
 		},
 	}
 
@@ -466,19 +603,26 @@ func NewFromArgs(argv []string) (dc *DumboChecker) {
 	}
 
 	if cfg.Help || len(argParseErrors) > 0 {
-		cfg.usageAndExit(argParseErrors)
+		usageAndExit(cfg.optSet, argParseErrors, true)
 	}
 
 	return
 }
 
-func (cfg *config) usageAndExit(errorStrings []string) {
+func usageAndExit(optSet *getopt.Set, errorStrings []string, listSubcommands bool) {
 
 	if len(errorStrings) > 0 {
 		fmt.Fprint(os.Stderr, "\nFatal error parsing arguments:\n\n")
 	}
 
-	cfg.optSet.PrintUsage(os.Stderr)
+	optSet.PrintUsage(os.Stderr)
+
+	if listSubcommands {
+		fmt.Fprint(os.Stderr, "\nAvailable subcommands:\n")
+		for _, name := range MapKeysList(subcommands) {
+			fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, subcommands[name].description)
+		}
+	}
 
 	if len(errorStrings) > 0 {
 		sort.Strings(errorStrings)
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An index patch transforms one index into another, both identified by their
+// contentHash():
+//
+//	8 bytes    magic "FDCPATCH"
+//	1 byte     format version
+//	32 bytes   content hash of the base index the patch applies to
+//	32 bytes   content hash of the index resulting from the patch
+//	the remainder of the file is a sequence of operations, each being a
+//	single opcode byte followed by:
+//	  'D' dataset upsert:  a dataset description as found in the index header
+//	  'd' dataset removal: uint8 dataset ID
+//	  'A' car addition:    a v2 car record, the CID must not be in the base
+//	  'M' car amendment:   a v2 car record, the CID must be in the base
+//	  'R' car removal:     the lower 16 bytes of the payload CID
+//
+// Patches are applied in order, the result of each becoming the base of the
+// next one.
+const (
+	patchMagic   = "FDCPATCH"
+	patchVersion = 1
+
+	patchOpDatasetUpsert = 'D'
+	patchOpDatasetRemove = 'd'
+	patchOpCarAdd        = 'A'
+	patchOpCarAmend      = 'M'
+	patchOpCarRemove     = 'R'
+)
+
+type indexPatch struct {
+	baseHash   [32]byte
+	resultHash [32]byte
+	ops        []byte
+}
+
+func parsePatch(d []byte) (*indexPatch, error) {
+
+	if len(d) < len(patchMagic)+1+64 || string(d[:len(patchMagic)]) != patchMagic {
+		return nil, errors.New("not an index patch")
+	}
+	d = d[len(patchMagic):]
+
+	if d[0] != patchVersion {
+		return nil, fmt.Errorf("unsupported patch format version %d", d[0])
+	}
+
+	p := &indexPatch{ops: d[65:]}
+	copy(p.baseHash[:], d[1:33])
+	copy(p.resultHash[:], d[33:65])
+	return p, nil
+}
+
+func (p *indexPatch) encode() []byte {
+	buf := make([]byte, 0, len(patchMagic)+1+64+len(p.ops))
+	buf = append(buf, patchMagic...)
+	buf = append(buf, patchVersion)
+	buf = append(buf, p.baseHash[:]...)
+	buf = append(buf, p.resultHash[:]...)
+	return append(buf, p.ops...)
+}
+
+// apply modifies idx in place, keeping rd up to date with its records: the
+// caller is responsible for verifying the base hash beforehand and the result
+// hash afterwards
+func (p *indexPatch) apply(idx *index, rd *recordsDigest) error {
+
+	recLen := indexRecordLen[indexLatestVersion]
+	d := p.ops
+	for opNum := 0; len(d) > 0; opNum++ {
+
+		op := d[0]
+		d = d[1:]
+
+		switch op {
+
+		case patchOpDatasetUpsert:
+			var ds *dataSet
+			var err error
+			if ds, d, err = parseDataset(d); err != nil {
+				return fmt.Errorf("operation #%d: %s", opNum, err)
+			}
+			idx.datasets[ds.ID] = ds
+
+		case patchOpDatasetRemove:
+			if len(d) < 1 {
+				return fmt.Errorf("operation #%d: truncated dataset removal", opNum)
+			}
+			if _, exists := idx.datasets[d[0]]; !exists {
+				return fmt.Errorf("operation #%d: removal of unknown dataset #%d", opNum, d[0])
+			}
+			delete(idx.datasets, d[0])
+			d = d[1:]
+
+		case patchOpCarAdd, patchOpCarAmend:
+			if len(d) < recLen {
+				return fmt.Errorf("operation #%d: truncated car record", opNum)
+			}
+			key, cd := parseRecord(d[:recLen], indexLatestVersion)
+			d = d[recLen:]
+
+			prev, exists := idx.cars[key]
+			if exists && op == patchOpCarAdd {
+				return fmt.Errorf("operation #%d: addition of already known car %x", opNum, key)
+			} else if !exists && op == patchOpCarAmend {
+				return fmt.Errorf("operation #%d: amendment of unknown car %x", opNum, key)
+			}
+			if exists {
+				rd.remove(key, prev)
+			}
+			rd.add(key, cd)
+			idx.cars[key] = cd
+
+		case patchOpCarRemove:
+			if len(d) < 16 {
+				return fmt.Errorf("operation #%d: truncated car removal", opNum)
+			}
+			var key [16]byte
+			copy(key[:], d[:16])
+			d = d[16:]
+
+			prev, exists := idx.cars[key]
+			if !exists {
+				return fmt.Errorf("operation #%d: removal of unknown car %x", opNum, key)
+			}
+			rd.remove(key, prev)
+			delete(idx.cars, key)
+
+		default:
+			return fmt.Errorf("operation #%d: unknown opcode 0x%02x", opNum, op)
+		}
+	}
+
+	return nil
+}
+
+// applyPatchChain verifies the hash chain of the supplied patches and applies
+// them to idx in order
+func applyPatchChain(idx *index, patches []*indexPatch) error {
+
+	if len(patches) == 0 {
+		return nil
+	}
+
+	// a single pass over the base records, the patches keep the digest current
+	rd := idx.recordsDigest()
+	curHash := idx.contentHash(rd)
+	for i, p := range patches {
+		if p.baseHash != curHash {
+			return fmt.Errorf(
+				"patch #%d applies to index %x, but the current index is %x",
+				i,
+				p.baseHash,
+				curHash,
+			)
+		}
+		if err := p.apply(idx, &rd); err != nil {
+			return fmt.Errorf("applying patch #%d failed: %s", i, err)
+		}
+		curHash = p.resultHash
+	}
+
+	if actual := idx.contentHash(rd); actual != curHash {
+		return fmt.Errorf(
+			"index after applying %d patches is %x, expected %x",
+			len(patches),
+			actual,
+			curHash,
+		)
+	}
+
+	return nil
+}
+
+// diffIndexes produces a patch turning base into target
+func diffIndexes(base, target *index) *indexPatch {
+
+	p := &indexPatch{
+		baseHash:   base.contentHash(base.recordsDigest()),
+		resultHash: target.contentHash(target.recordsDigest()),
+	}
+
+	for _, id := range sortedDatasetIDs(base) {
+		if _, exists := target.datasets[id]; !exists {
+			p.ops = append(p.ops, patchOpDatasetRemove, id)
+		}
+	}
+	for _, id := range sortedDatasetIDs(target) {
+		if ds, exists := base.datasets[id]; !exists || *ds != *target.datasets[id] {
+			p.ops = appendDataset(append(p.ops, patchOpDatasetUpsert), target.datasets[id])
+		}
+	}
+
+	for _, key := range sortedCarKeys(base) {
+		if _, exists := target.cars[key]; !exists {
+			p.ops = append(p.ops, patchOpCarRemove)
+			p.ops = append(p.ops, key[:]...)
+		}
+	}
+	for _, key := range sortedCarKeys(target) {
+		cd := target.cars[key]
+		if baseCd, exists := base.cars[key]; !exists {
+			p.ops = appendRecord(append(p.ops, patchOpCarAdd), key, cd)
+		} else if baseCd != cd {
+			p.ops = appendRecord(append(p.ops, patchOpCarAmend), key, cd)
+		}
+	}
+
+	return p
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testIndex(datasets []*dataSet, cars map[[16]byte]carData) *index {
+	idx := &index{
+		datasets: make(map[uint8]*dataSet),
+		cars:     make(map[[16]byte]carData),
+	}
+	for _, ds := range datasets {
+		dsCopy := *ds
+		idx.datasets[ds.ID] = &dsCopy
+	}
+	for k, cd := range cars {
+		idx.cars[k] = cd
+	}
+	return idx
+}
+
+func TestPatchRoundTrip(t *testing.T) {
+
+	base := testIndex(
+		[]*dataSet{
+			{ID: 1, Name: "one", ExpectedCars: 2},
+			{ID: 2, Name: "two", Owner: "someone", ExpectedCars: 1},
+			{ID: 3, Name: "three"},
+		},
+		map[[16]byte]carData{
+			{1}: {datasetID: 1, expectedSize: 100, commP: [16]byte{0xa}},
+			{2}: {datasetID: 1, expectedSize: 200, commP: [16]byte{0xb}},
+			{3}: {datasetID: 2, expectedSize: 300, commP: [16]byte{0xc}},
+		},
+	)
+	target := testIndex(
+		[]*dataSet{
+			{ID: 1, Name: "one", ExpectedCars: 2},
+			{ID: 2, Name: "two", Description: "amended", Owner: "someone", ExpectedCars: 2},
+			{ID: 4, Name: "four", ExpectedCars: 1},
+		},
+		map[[16]byte]carData{
+			{1}: {datasetID: 1, expectedSize: 100, commP: [16]byte{0xa}},
+			{3}: {datasetID: 2, expectedSize: 5 << 30, commP: [16]byte{0xc}},
+			{4}: {datasetID: 2, expectedSize: 400, commP: [16]byte{0xd}},
+			{5}: {datasetID: 4, expectedSize: 500, commP: [16]byte{0xe}},
+		},
+	)
+
+	p, err := parsePatch(diffIndexes(base, target).encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyPatchChain(base, []*indexPatch{p}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(base, target) {
+		t.Errorf("patched index %#v differs from the target %#v", base, target)
+	}
+
+	// a chain continuing from the target, back to where it started
+	p1 := diffIndexes(target, base)
+	p2 := diffIndexes(base, target)
+	if err := applyPatchChain(base, []*indexPatch{p1, p2}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(base, target) {
+		t.Error("index patched by a chain differs from the target")
+	}
+}
+
+func TestPatchRejected(t *testing.T) {
+
+	base := testIndex(
+		[]*dataSet{{ID: 1, Name: "one"}},
+		map[[16]byte]carData{{1}: {datasetID: 1, expectedSize: 100}},
+	)
+	target := testIndex(
+		[]*dataSet{{ID: 1, Name: "one"}},
+		map[[16]byte]carData{{1}: {datasetID: 1, expectedSize: 100}, {2}: {datasetID: 1, expectedSize: 200}},
+	)
+	good := diffIndexes(base, target)
+
+	withOps := func(ops ...byte) *indexPatch {
+		return &indexPatch{baseHash: good.baseHash, resultHash: good.resultHash, ops: ops}
+	}
+	truncated := func(full []byte, keep int) []byte { return append([]byte{}, full[:keep]...) }
+
+	for name, tc := range map[string]struct {
+		patches []*indexPatch
+		errText string
+	}{
+		"base hash mismatch":         {[]*indexPatch{good, good}, "applies to index"},
+		"result hash mismatch":       {[]*indexPatch{{baseHash: good.baseHash, resultHash: good.baseHash, ops: good.ops}}, "expected"},
+		"unknown opcode":             {[]*indexPatch{withOps('X')}, "unknown opcode 0x58"},
+		"truncated dataset upsert":   {[]*indexPatch{withOps(truncated(appendDataset([]byte{patchOpDatasetUpsert}, &dataSet{ID: 2, Name: "two"}), 8)...)}, "truncated"},
+		"truncated dataset removal":  {[]*indexPatch{withOps(patchOpDatasetRemove)}, "truncated dataset removal"},
+		"truncated car addition":     {[]*indexPatch{withOps(truncated(good.ops, len(good.ops)-1)...)}, "truncated car record"},
+		"truncated car amendment":    {[]*indexPatch{withOps(patchOpCarAmend, 1, 2, 3)}, "truncated car record"},
+		"truncated car removal":      {[]*indexPatch{withOps(patchOpCarRemove, 1)}, "truncated car removal"},
+		"addition of a known car":    {[]*indexPatch{withOps(appendRecord([]byte{patchOpCarAdd}, [16]byte{1}, carData{})...)}, "already known"},
+		"removal of an unknown car":  {[]*indexPatch{withOps(append([]byte{patchOpCarRemove}, make([]byte, 16)...)...)}, "removal of unknown car"},
+		"removal of unknown dataset": {[]*indexPatch{withOps(patchOpDatasetRemove, 9)}, "removal of unknown dataset #9"},
+	} {
+		idx := testIndex([]*dataSet{{ID: 1, Name: "one"}}, base.cars)
+		err := applyPatchChain(idx, tc.patches)
+		if err == nil || !strings.Contains(err.Error(), tc.errText) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, tc.errText, err)
+		}
+	}
+
+	encoded := good.encode()
+	for name, d := range map[string][]byte{
+		"empty":             nil,
+		"bad magic":         append([]byte("FDCINDEX"), encoded[8:]...),
+		"truncated header":  encoded[:len(patchMagic)+1+63],
+		"unknown version":   append(append([]byte(patchMagic), patchVersion+1), encoded[len(patchMagic)+1:]...),
+		"bare magic string": []byte(patchMagic),
+	} {
+		if _, err := parsePatch(d); err == nil {
+			t.Errorf("%s: patch parsed", name)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/ipfs/go-cid"
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/util/argparser"
+	"github.com/ribasushi/fil-discover-check/internal/util/stream"
+)
+
+type subcommand struct {
+	description string
+	run         func(argv []string)
+	standalone  bool // does not need the index of known CARs loaded
+}
+
+var subcommands map[string]subcommand
+
+func init() {
+	// assigned in init() to avoid an initialization loop through usageAndExit()
+	subcommands = map[string]subcommand{
+		"datasets": {
+			description: "List the dataset registry carried in the index of known CARs",
+			run:         listDatasets,
+		},
+		"lookup": {
+			description: "Resolve payload CIDs against the index of known CARs",
+			run:         lookupCids,
+		},
+		"index": {
+			description: "Maintenance of index files: 'index patch <base> <target>' writes out a patch between two full indexes, applied at startup when placed next to the executable",
+			run:         indexMaintenance,
+			standalone:  true,
+		},
+	}
+}
+
+// parseSubcommandArgs registers the getopt-tagged cfg and parses argv,
+// exiting with usage on --help or any errors
+func parseSubcommandArgs(argv []string, cfg interface{}, help *bool, parameters string) *getopt.Set {
+
+	optSet := getopt.New()
+	if err := options.RegisterSet("", cfg, optSet); err != nil {
+		log.Fatalf("option set registration failed: %s", err)
+	}
+	optSet.SetProgram(fmt.Sprintf("%s %s", filepath.Base(os.Args[0]), argv[0]))
+	optSet.SetParameters(parameters)
+
+	var argParseErrors []string
+	if parameters == "" {
+		argParseErrors = argparser.Parse(argv, optSet)
+	} else if err := optSet.Getopt(argv, nil); err != nil {
+		argParseErrors = append(argParseErrors, err.Error())
+	}
+
+	if *help || len(argParseErrors) > 0 {
+		usageAndExit(optSet, argParseErrors, false)
+	}
+
+	return optSet
+}
+
+func listDatasets(argv []string) {
+
+	cfg := struct {
+		JSON bool `getopt:"-j --json  Output the registry as JSON"`
+		Help bool `getopt:"-h --help  Display help"`
+	}{}
+	parseSubcommandArgs(argv, &cfg, &cfg.Help, "")
+
+	type datasetListing struct {
+		dataSet
+		IndexedCars int
+	}
+
+	indexed := make(map[uint8]int, len(dataSets))
+	for _, kc := range knownCars {
+		indexed[kc.datasetID]++
+	}
+
+	list := make([]datasetListing, 0, len(indexed))
+	for id, ds := range dataSets {
+		list = append(list, datasetListing{dataSet: *ds, IndexedCars: indexed[id]})
+	}
+	for id, count := range indexed {
+		if _, registered := dataSets[id]; !registered {
+			name, _ := datasetName(id)
+			list = append(list, datasetListing{
+				dataSet:     dataSet{ID: id, Name: name},
+				IndexedCars: count,
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	if cfg.JSON {
+		js, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			log.Fatalf("JSON encoding failed: %s", err)
+		}
+		fmt.Printf("%s\n", js)
+		return
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tOWNER\tEXPECTED CARS\tINDEXED CARS\tDESCRIPTION")
+	for _, ds := range list {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%s\n",
+			ds.ID,
+			ds.Name,
+			ds.Owner,
+			ds.ExpectedCars,
+			ds.IndexedCars,
+			ds.Description,
+		)
+	}
+	tw.Flush()
+}
+
+type lookupResult struct {
+	Cid          string
+	Found        bool
+	DatasetID    uint8  `json:",omitempty"`
+	DatasetName  string `json:",omitempty"`
+	ExpectedSize uint64 `json:",omitempty"`
+	CommPTail    string `json:",omitempty"`
+	Error        string `json:",omitempty"`
+}
+
+func lookupCids(argv []string) {
+
+	cfg := struct {
+		JSON bool `getopt:"-j --json  Output one JSON object per line instead of tab-separated text"`
+		Help bool `getopt:"-h --help  Display help"`
+	}{}
+	optSet := parseSubcommandArgs(argv, &cfg, &cfg.Help, "[cid ...]\n\nWithout arguments whitespace-separated CIDs are read from stdIN")
+
+	var cidStrings []string
+	if optSet.NArgs() > 0 {
+		cidStrings = optSet.Args()
+	} else {
+		s := bufio.NewScanner(os.Stdin)
+		s.Split(bufio.ScanWords)
+		for s.Scan() {
+			cidStrings = append(cidStrings, s.Text())
+		}
+		if err := s.Err(); err != nil {
+			log.Fatalf("Reading CIDs from stdIN failed: %s", err)
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	var notFound int
+	for _, cs := range cidStrings {
+		res := lookupCid(cs)
+		if !res.Found {
+			notFound++
+		}
+
+		if cfg.JSON {
+			js, err := json.Marshal(res)
+			if err != nil {
+				log.Fatalf("JSON encoding failed: %s", err)
+			}
+			fmt.Fprintf(out, "%s\n", js)
+		} else if res.Error != "" {
+			fmt.Fprintf(out, "%s\tERROR\t%s\n", res.Cid, res.Error)
+		} else if !res.Found {
+			fmt.Fprintf(out, "%s\tNOT FOUND\n", res.Cid)
+		} else {
+			fmt.Fprintf(out, "%s\t%s\t%d\t%s\n", res.Cid, res.DatasetName, res.ExpectedSize, res.CommPTail)
+		}
+	}
+
+	if notFound > 0 {
+		out.Flush()
+		log.Printf("%d out of %d CIDs not found in the Filecoin Discover set", notFound, len(cidStrings))
+		os.Exit(1)
+	}
+}
+
+func lookupCid(cidString string) (res lookupResult) {
+	res.Cid = cidString
+
+	c, err := cid.Parse(cidString)
+	if err != nil {
+		res.Error = fmt.Sprintf("undecodeable CID: %s", err)
+		return
+	}
+	res.Cid = c.String()
+
+	// the index is keyed by the trailing bytes of the CID: anything shorter,
+	// e.g. an identity CID, is not a CAR of the set
+	var key [16]byte
+	cb := c.Bytes()
+	if len(cb) < len(key) {
+		return
+	}
+	copy(key[:], cb[len(cb)-len(key):])
+
+	known, exists := knownCars[key]
+	if !exists {
+		return
+	}
+
+	res.Found = true
+	res.DatasetID = known.datasetID
+	res.DatasetName, _ = datasetName(known.datasetID)
+	res.ExpectedSize = known.expectedSize
+	res.CommPTail = fmt.Sprintf("%x", known.commP)
+	return
+}
+
+func indexMaintenance(argv []string) {
+
+	if len(argv) < 2 || argv[1] != "patch" {
+		fmt.Fprintf(os.Stderr, "\nUsage: %s index patch [-h] [-o path] <base-index> <target-index>\n\n", filepath.Base(os.Args[0]))
+		os.Exit(2)
+	}
+
+	cfg := struct {
+		Output string `getopt:"-o --output=path  Write the patch to this file instead of stdOUT"`
+		Help   bool   `getopt:"-h --help         Display help"`
+	}{}
+	optSet := parseSubcommandArgs(
+		append([]string{"index patch"}, argv[2:]...),
+		&cfg, &cfg.Help,
+		"<base-index> <target-index>",
+	)
+
+	if optSet.NArgs() != 2 {
+		usageAndExit(optSet, []string{"Exactly two index files must be supplied"}, false)
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.Output != "" {
+		fh, err := os.OpenFile(cfg.Output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			log.Fatalf("Unable to open patch output: %s", err)
+		}
+		defer func() {
+			if err := fh.Close(); err != nil {
+				log.Fatalf("Closing patch output failed: %s", err)
+			}
+		}()
+		out = fh
+	} else if stream.IsTTY(os.Stdout) {
+		usageAndExit(optSet, []string{"Refusing to write a binary patch to a terminal, use --output"}, false)
+	}
+
+	indexes := make([]*index, 2)
+	for i, fn := range optSet.Args() {
+		d, err := ioutil.ReadFile(fn)
+		if err != nil {
+			log.Fatalf("Unable to read index '%s': %s", fn, err)
+		}
+		if indexes[i], err = parseIndex(d); err != nil {
+			log.Fatalf("Unable to parse index '%s': %s", fn, err)
+		}
+	}
+
+	p := diffIndexes(indexes[0], indexes[1])
+	encoded := p.encode()
+	if _, err := out.Write(encoded); err != nil {
+		log.Fatalf("Writing patch failed: %s", err)
+	}
+
+	log.Printf("Patch from %x to %x is %d bytes long", p.baseHash, p.resultHash, len(encoded))
+}
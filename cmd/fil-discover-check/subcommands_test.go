@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestLookupCid(t *testing.T) {
+
+	known, err := cid.Parse("bafykbzaceaeqhm77anl5mv2wjkmh4ofyf6s6eww3ujfmhtsfab65vi3rlccaw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key [16]byte
+	copy(key[:], known.Bytes()[len(known.Bytes())-16:])
+
+	defer func(ds map[uint8]*dataSet, kc map[[16]byte]carData) { dataSets, knownCars = ds, kc }(dataSets, knownCars)
+	dataSets = map[uint8]*dataSet{3: {ID: 3, Name: "three"}}
+	knownCars = map[[16]byte]carData{key: {datasetID: 3, expectedSize: 42}}
+
+	if res := lookupCid(known.String()); !res.Found || res.DatasetName != "three" || res.ExpectedSize != 42 {
+		t.Errorf("known CID: unexpected %#v", res)
+	}
+
+	// identity CIDs are shorter than the index keys
+	for _, c := range []string{"bafkqaaa", "bafkqaaik"} {
+		if res := lookupCid(c); res.Found || res.Error != "" {
+			t.Errorf("%s: unexpected %#v", c, res)
+		}
+	}
+
+	if res := lookupCid("not-a-cid"); res.Found || res.Error == "" {
+		t.Errorf("undecodeable CID: unexpected %#v", res)
+	}
+}
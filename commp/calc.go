@@ -0,0 +1,28 @@
+package commp
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/collector/filcommp"
+)
+
+// Calc is a streaming commP calculator implementing io.Writer and hash.Hash,
+// for callers feeding the payload from a pipeline of their own instead of
+// through a Dagger. The zero value is ready for use. Digest() returns the
+// commP together with the padded piece size, and enforces the same 127 byte
+// minimum as the fil-commP collector, while Write() rejects data past
+// MaxPiecePayload. Sum() panics below the minimum.
+type Calc = filcommp.Calc
+
+// MaxPiecePayload is the largest payload a single piece can commit to
+const MaxPiecePayload = filcommp.MaxPiecePayload
+
+// PieceCID wraps a 32 byte commP digest, as returned by Calc.Digest(), into
+// a piece CID
+func PieceCID(commP []byte) (cid.Cid, error) {
+	if len(commP) != 32 {
+		return cid.Undef, fmt.Errorf("commP digest must be 32 bytes long, got %d", len(commP))
+	}
+	return cid.Cast(append([]byte(filcommp.CidPrefix), commP...))
+}
@@ -0,0 +1,148 @@
+package commp_test
+
+import (
+	"bytes"
+	"hash"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/ribasushi/fil-discover-check/commp"
+	"github.com/ribasushi/fil-discover-check/dagger"
+)
+
+func collectorResult(t *testing.T, payload []byte) *dagger.Result {
+	opts := dagger.DefaultOptions()
+	opts.Collectors = []dagger.CollectorConfig{dagger.FilCommPCollector{}}
+	dgr, err := dagger.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dgr.Destroy()
+
+	res, err := dgr.ProcessReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res[0]
+}
+
+func TestCalcMatchesCollector(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	var c commp.Calc
+
+	for _, size := range []int{127, 128, 254, 1000, 127 * 513, 3<<20 + 7} {
+		payload := make([]byte, size)
+		rng.Read(payload) // nolint:errcheck
+		want := collectorResult(t, payload)
+
+		c.Reset()
+		for p := payload; len(p) > 0; {
+			n := rng.Intn(400) + 1
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := c.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+
+			// intermediate digests must not disturb the state
+			if rng.Intn(20) == 0 {
+				c.Digest() // nolint:errcheck
+			}
+		}
+
+		commP, paddedSize, err := c.Digest()
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		pieceCID, err := commp.PieceCID(commP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pieceCID.Equals(want.Cid) || paddedSize != want.PaddedPieceSize {
+			t.Errorf("%d bytes: Calc result %s/%d differs from collector result %s/%d", size, pieceCID, paddedSize, want.Cid, want.PaddedPieceSize)
+		}
+
+		var copied commp.Calc
+		if _, err := io.Copy(&copied, bytes.NewReader(payload)); err != nil {
+			t.Fatal(err)
+		}
+		if d, _, _ := copied.Digest(); !bytes.Equal(d, commP) {
+			t.Errorf("%d bytes: io.Copy() into a Calc produced a different commP", size)
+		}
+	}
+}
+
+func TestCalcMinimumPayload(t *testing.T) {
+
+	var c commp.Calc
+	if _, _, err := c.Digest(); err == nil {
+		t.Error("digest of an empty Calc succeeded")
+	}
+	c.Write(make([]byte, 126)) // nolint:errcheck
+	if _, _, err := c.Digest(); err == nil {
+		t.Error("digest of 126 bytes succeeded")
+	}
+	c.Write(make([]byte, 1)) // nolint:errcheck
+	if _, _, err := c.Digest(); err != nil {
+		t.Errorf("digest of 127 bytes failed: %s", err)
+	}
+}
+
+func TestCalcHash(t *testing.T) {
+
+	var h hash.Hash = new(commp.Calc)
+	if h.Size() != 32 {
+		t.Errorf("digest size of %d bytes", h.Size())
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Sum() of 126 bytes did not panic")
+			}
+		}()
+		h.Write(make([]byte, 126)) // nolint:errcheck
+		h.Sum(nil)
+	}()
+
+	h.Write(make([]byte, 1000)) // nolint:errcheck
+	commP, _, err := h.(*commp.Calc).Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := []byte("prefix")
+	if sum := h.Sum(prefix); !bytes.Equal(sum, append(prefix, commP...)) {
+		t.Errorf("Sum() returned %x instead of the prefixed digest %x", sum, commP)
+	}
+}
+
+func BenchmarkCalcWrite(b *testing.B) {
+	payload := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(payload) // nolint:errcheck
+
+	var c commp.Calc
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Reset()
+		c.Write(payload) // nolint:errcheck
+	}
+}
+
+func BenchmarkCalcDigest(b *testing.B) {
+	var c commp.Calc
+	c.Write(make([]byte, 1<<20+5)) // nolint:errcheck
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := c.Digest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
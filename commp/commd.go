@@ -0,0 +1,94 @@
+package commp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/collector/filcommp"
+)
+
+// Sector sizes of the Filecoin mainnet
+const (
+	SectorSize32GiB = uint64(32 << 30)
+	SectorSize64GiB = uint64(64 << 30)
+)
+
+// PieceInfo describes a piece placed into a sector
+type PieceInfo struct {
+	// Piece CID as produced by the fil-commP collector
+	PieceCID cid.Cid
+	// Padded size of the piece: a power of two no smaller than 128 bytes
+	Size uint64
+}
+
+type treeNode struct {
+	commitment []byte
+	size       uint64
+}
+
+// UnsealedSectorCID computes the data commitment (CommD) of a sector holding
+// the supplied pieces in order. Each piece is placed at the next offset
+// aligned to its own size, and the gaps as well as the remainder of the sector
+// are filled with zero pieces.
+func UnsealedSectorCID(sectorSize uint64, pieces []PieceInfo) (cid.Cid, error) {
+
+	if sectorSize < 128 || sectorSize&(sectorSize-1) != 0 || filcommp.ZeroPieceCommitment(sectorSize/2) == nil {
+		return cid.Undef, fmt.Errorf("unsupported sector size %d", sectorSize)
+	}
+	if len(pieces) == 0 {
+		return cid.Undef, errors.New("at least one piece is required")
+	}
+
+	// the stack always holds subtrees of strictly decreasing size, reflecting
+	// the binary representation of the current offset
+	var stack []treeNode
+	push := func(commitment []byte, size uint64) {
+		stack = append(stack, treeNode{commitment: commitment, size: size})
+		for len(stack) > 1 && stack[len(stack)-2].size == stack[len(stack)-1].size {
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			stack = append(stack[:len(stack)-2], treeNode{
+				commitment: filcommp.Hash254(left.commitment, right.commitment),
+				size:       2 * left.size,
+			})
+		}
+	}
+	padTo := func(alignment uint64, offset uint64) uint64 {
+		for offset%alignment != 0 {
+			padSize := offset & -offset
+			push(filcommp.ZeroPieceCommitment(padSize), padSize)
+			offset += padSize
+		}
+		return offset
+	}
+
+	var offset uint64
+	for i, p := range pieces {
+
+		if p.Size < 128 || p.Size&(p.Size-1) != 0 {
+			return cid.Undef, fmt.Errorf("piece #%d: padded size %d is not a power of two of at least 128 bytes", i, p.Size)
+		}
+
+		commP, err := pieceCommitment(p.PieceCID)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("piece #%d: %s", i, err)
+		}
+
+		offset = padTo(p.Size, offset)
+		if offset+p.Size > sectorSize {
+			return cid.Undef, fmt.Errorf(
+				"piece #%d: %d bytes placed at offset %d exceed the sector size of %d bytes",
+				i, p.Size, offset, sectorSize,
+			)
+		}
+
+		push(commP, p.Size)
+		offset += p.Size
+	}
+
+	if offset < sectorSize {
+		padTo(sectorSize, offset)
+	}
+
+	return cid.Cast(append([]byte(filcommp.CidPrefix), stack[0].commitment...))
+}
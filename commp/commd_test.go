@@ -0,0 +1,115 @@
+package commp_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ribasushi/fil-discover-check/commp"
+)
+
+// calcPieceCID returns the piece CID of payload as computed by a Calc
+func calcPieceCID(t *testing.T, payload []byte) (cid.Cid, uint64) {
+	var c commp.Calc
+	c.Write(payload) // nolint:errcheck
+	commP, paddedSize, err := c.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieceCID, err := commp.PieceCID(commP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pieceCID, paddedSize
+}
+
+func TestUnsealedSectorCIDZeroSector(t *testing.T) {
+
+	// the CommD of an entirely empty 32GiB sector
+	const emptySector32GiB = "baga6ea4seaqao7s73y24kcutaosvacpdjgfe5pw76ooefnyqw4ynr3d2y6x2mpq"
+
+	zeroPiece, size := calcPieceCID(t, make([]byte, 127))
+	commD, err := commp.UnsealedSectorCID(commp.SectorSize32GiB, []commp.PieceInfo{{PieceCID: zeroPiece, Size: size}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commD.String() != emptySector32GiB {
+		t.Fatalf("got %s, expected %s", commD, emptySector32GiB)
+	}
+
+	// a 64GiB sector is empty no matter how its zeroes are split into pieces
+	half, _ := cid.Parse(emptySector32GiB)
+	want, err := commp.UnsealedSectorCID(commp.SectorSize64GiB, []commp.PieceInfo{
+		{PieceCID: half, Size: commp.SectorSize32GiB},
+		{PieceCID: half, Size: commp.SectorSize32GiB},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commD, err = commp.UnsealedSectorCID(commp.SectorSize64GiB, []commp.PieceInfo{{PieceCID: zeroPiece, Size: size}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !commD.Equals(want) || commD.Equals(half) {
+		t.Errorf("empty 64GiB sector: got %s, expected %s", commD, want)
+	}
+}
+
+func TestUnsealedSectorCIDAlignment(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	small := make([]byte, 127)
+	large := make([]byte, 508)
+	rng.Read(small) // nolint:errcheck
+	rng.Read(large) // nolint:errcheck
+
+	smallCID, smallSize := calcPieceCID(t, small)
+	largeCID, largeSize := calcPieceCID(t, large)
+	if smallSize != 128 || largeSize != 512 {
+		t.Fatalf("unexpected piece sizes %d and %d", smallSize, largeSize)
+	}
+
+	// the large piece is aligned to offset 512, the zeroes between the
+	// pieces and past them are part of the sector payload
+	const sectorSize = 2048
+	sector := make([]byte, sectorSize/128*127)
+	copy(sector, small)
+	copy(sector[512/128*127:], large)
+	want, _ := calcPieceCID(t, sector)
+
+	commD, err := commp.UnsealedSectorCID(sectorSize, []commp.PieceInfo{
+		{PieceCID: smallCID, Size: smallSize},
+		{PieceCID: largeCID, Size: largeSize},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !commD.Equals(want) {
+		t.Errorf("got %s, expected %s", commD, want)
+	}
+}
+
+func TestUnsealedSectorCIDErrors(t *testing.T) {
+
+	zeroPiece, _ := calcPieceCID(t, make([]byte, 127))
+	notAPiece, _ := cid.Parse("bafkqaaa")
+
+	for name, tc := range map[string]struct {
+		sectorSize uint64
+		pieces     []commp.PieceInfo
+	}{
+		"sector size not a power of two": {1000, []commp.PieceInfo{{zeroPiece, 128}}},
+		"sector size too small":          {64, []commp.PieceInfo{{zeroPiece, 128}}},
+		"sector size too large":          {128 << 30, []commp.PieceInfo{{zeroPiece, 128}}},
+		"no pieces":                      {2048, nil},
+		"piece size not a power of two":  {2048, []commp.PieceInfo{{zeroPiece, 384}}},
+		"piece size too small":           {2048, []commp.PieceInfo{{zeroPiece, 64}}},
+		"not a piece CID":                {2048, []commp.PieceInfo{{notAPiece, 128}}},
+		"piece larger than the sector":   {2048, []commp.PieceInfo{{zeroPiece, 4096}}},
+		"aligned piece overflowing":      {2048, []commp.PieceInfo{{zeroPiece, 128}, {zeroPiece, 1024}, {zeroPiece, 1024}}},
+	} {
+		if _, err := commp.UnsealedSectorCID(tc.sectorSize, tc.pieces); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package commp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/collector/filcommp"
+)
+
+// Tree is the complete commitment tree of a piece, returned in
+// dagger.Result.PieceTree when the fil-commP collector is configured with
+// RetainTree. It produces inclusion proofs of individual leaves or of
+// arbitrary payload ranges.
+type Tree = filcommp.Tree
+
+// Proof is an inclusion proof of a contiguous run of leaves within a piece
+type Proof = filcommp.Proof
+
+// VerifyLeaves checks that the concatenated 32 byte leaves, starting at leaf
+// index firstLeaf, belong to the piece identified by pieceCID and its padded
+// size
+func VerifyLeaves(pieceCID cid.Cid, paddedPieceSize, firstLeaf uint64, leaves []byte, proof *Proof) error {
+	commP, err := pieceCommitment(pieceCID)
+	if err != nil {
+		return err
+	}
+	return filcommp.VerifyLeaves(commP, paddedPieceSize, firstLeaf, leaves, proof)
+}
+
+// VerifyPayloadRange checks that data, served from the given offset within
+// the unpadded payload of payloadSize bytes, belongs to the piece identified
+// by pieceCID and its padded size. Ranges reaching past the payload are
+// rejected, even when the extra bytes match the zero padding of the piece.
+// The piece CID does not commit to the payload size: it must come from a
+// trusted source, such as the deal. The proof is obtained from
+// Tree.ProvePayloadRange().
+func VerifyPayloadRange(pieceCID cid.Cid, paddedPieceSize, payloadSize, offset uint64, data []byte, proof *Proof) error {
+	commP, err := pieceCommitment(pieceCID)
+	if err != nil {
+		return err
+	}
+	return filcommp.VerifyPayloadRange(commP, paddedPieceSize, payloadSize, offset, data, proof)
+}
+
+// pieceCommitment returns the commP digest of a piece CID
+func pieceCommitment(pieceCID cid.Cid) ([]byte, error) {
+	cb := pieceCID.Bytes()
+	if len(cb) != len(filcommp.CidPrefix)+32 || !strings.HasPrefix(string(cb), filcommp.CidPrefix) {
+		return nil, fmt.Errorf("%s is not a piece CID", pieceCID)
+	}
+	return cb[len(filcommp.CidPrefix):], nil
+}
+
+// LoadTree reads a tree sidecar previously written via Tree.WriteTo(),
+// verifying that every stored level is consistent with the one below it
+func LoadTree(r io.Reader) (*Tree, error) { return filcommp.LoadTree(r) }
@@ -0,0 +1,191 @@
+package commp_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/ribasushi/fil-discover-check/commp"
+	"github.com/ribasushi/fil-discover-check/dagger"
+)
+
+func retainedTree(t *testing.T, payload []byte, baseLevel int) (*dagger.Result, *commp.Tree) {
+	opts := dagger.DefaultOptions()
+	opts.Collectors = []dagger.CollectorConfig{dagger.FilCommPCollector{RetainTree: true, TreeBaseLevel: baseLevel}}
+	dgr, err := dagger.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dgr.Destroy()
+
+	res, err := dgr.ProcessReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res[0].PieceTree.AttachPayload(bytes.NewReader(payload))
+	return res[0], res[0].PieceTree
+}
+
+func TestVerifyPayloadRange(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	payload := make([]byte, 100000)
+	rng.Read(payload) // nolint:errcheck
+	res, tree := retainedTree(t, payload, 3)
+	size := uint64(len(payload))
+
+	for i := 0; i < 50; i++ {
+		offset := uint64(rng.Intn(len(payload)))
+		length := uint64(rng.Intn(len(payload)-int(offset))) + 1
+		proof, err := tree.ProvePayloadRange(offset, length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := append([]byte{}, payload[offset:offset+length]...)
+		if err := commp.VerifyPayloadRange(res.Cid, res.PaddedPieceSize, size, offset, data, proof); err != nil {
+			t.Fatalf("range of %d bytes at %d: %s", length, offset, err)
+		}
+
+		data[rng.Intn(len(data))] ^= 1
+		if commp.VerifyPayloadRange(res.Cid, res.PaddedPieceSize, size, offset, data, proof) == nil {
+			t.Fatalf("tampered range of %d bytes at %d verified", length, offset)
+		}
+	}
+
+	// the zero padding past the payload is part of the piece, but not of
+	// the payload
+	offset := size - 10
+	proof, err := tree.ProvePayloadRange(offset, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commp.VerifyPayloadRange(res.Cid, res.PaddedPieceSize, size, offset, payload[offset:], proof); err != nil {
+		t.Fatalf("payload tail: %s", err)
+	}
+	extended := append(append([]byte{}, payload[offset:]...), 0, 0, 0)
+	if commp.VerifyPayloadRange(res.Cid, res.PaddedPieceSize, size, offset, extended, proof) == nil {
+		t.Error("range extended with zero padding verified")
+	}
+	padded := &commp.Proof{Head: proof.Head, Tail: append(proof.Tail, 0, 0, 0), Siblings: proof.Siblings}
+	if commp.VerifyPayloadRange(res.Cid, res.PaddedPieceSize, size, offset, payload[offset:], padded) == nil {
+		t.Error("proof tail extended with zero padding verified")
+	}
+}
+
+func TestLoadTree(t *testing.T) {
+
+	payload := make([]byte, 1<<20+5)
+	rand.New(rand.NewSource(1)).Read(payload) // nolint:errcheck
+
+	for _, base := range []int{0, 4, 12} {
+		res, tree := retainedTree(t, payload, base)
+
+		var sidecar bytes.Buffer
+		if _, err := tree.WriteTo(&sidecar); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := commp.LoadTree(bytes.NewReader(sidecar.Bytes()))
+		if err != nil {
+			t.Fatalf("base level %d: %s", base, err)
+		}
+		if !bytes.Equal(loaded.CommP(), res.Cid.Bytes()[len(res.Cid.Bytes())-32:]) || loaded.PaddedPieceSize() != res.PaddedPieceSize {
+			t.Errorf("base level %d: loaded tree differs from the retained one", base)
+		}
+
+		// a flipped bit in the stored nodes below the root
+		corrupt := append([]byte{}, sidecar.Bytes()...)
+		corrupt[len(corrupt)/2] ^= 1
+		if _, err := commp.LoadTree(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("base level %d: corrupt sidecar loaded", base)
+		}
+		if _, err := commp.LoadTree(bytes.NewReader(sidecar.Bytes()[:sidecar.Len()-1])); err == nil {
+			t.Errorf("base level %d: truncated sidecar loaded", base)
+		}
+	}
+}
+
+func TestLoadTreeForgedHeader(t *testing.T) {
+
+	// a header announcing every level of the largest piece, with no nodes
+	hdr := []byte("fcpTREE1")
+	hdr = append(hdr, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(hdr[len(hdr)-8:], commp.MaxPiecePayload)
+	hdr = append(hdr, 0, 32)
+	hdr = append(hdr, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(hdr[len(hdr)-8:], (commp.MaxPiecePayload+126)/127*4)
+	hdr = append(hdr, make([]byte, 4096)...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := commp.LoadTree(bytes.NewReader(hdr))
+	runtime.ReadMemStats(&after)
+
+	if err == nil {
+		t.Fatal("truncated sidecar loaded")
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8<<20 {
+		t.Errorf("%d bytes allocated for a %d byte sidecar", allocated, len(hdr))
+	}
+}
+
+func TestVerifyLargestPiece(t *testing.T) {
+
+	const pieceSize = 64 << 30
+
+	opts := dagger.DefaultOptions()
+	opts.Collectors = []dagger.CollectorConfig{dagger.FilCommPCollector{RetainTree: true, PaddedPieceSize: pieceSize}}
+	dgr, err := dagger.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dgr.Destroy()
+
+	payload := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(payload) // nolint:errcheck
+	res, err := dgr.ProcessReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := res[0].PieceTree
+	if res[0].PaddedPieceSize != pieceSize || tree.PaddedPieceSize() != pieceSize {
+		t.Fatalf("piece of %d bytes instead of %d", res[0].PaddedPieceSize, pieceSize)
+	}
+
+	for _, leaf := range []uint64{0, 5, pieceSize/32 - 1} {
+		proof, err := tree.ProveLeaf(leaf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, _ := tree.Leaf(leaf)
+		if err := commp.VerifyLeaves(res[0].Cid, pieceSize, leaf, l, proof); err != nil {
+			t.Errorf("leaf %d: %s", leaf, err)
+		}
+	}
+
+	proof, err := tree.ProvePayloadRange(100, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commp.VerifyPayloadRange(res[0].Cid, pieceSize, uint64(len(payload)), 100, payload[100:400], proof); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyWithoutProof(t *testing.T) {
+
+	_, tree := retainedTree(t, make([]byte, 1000), 0)
+	pieceCID, err := commp.PieceCID(tree.CommP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := tree.Leaf(0)
+
+	if commp.VerifyLeaves(pieceCID, tree.PaddedPieceSize(), 0, leaf, nil) == nil {
+		t.Error("leaves verified without a proof")
+	}
+	if commp.VerifyPayloadRange(pieceCID, tree.PaddedPieceSize(), 1000, 0, make([]byte, 10), nil) == nil {
+		t.Error("payload range verified without a proof")
+	}
+}
@@ -0,0 +1,645 @@
+package dagger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+	"github.com/pborman/options"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/util/argparser"
+	"github.com/ribasushi/fil-discover-check/internal/util/stream"
+	"github.com/ribasushi/fil-discover-check/internal/util/text"
+)
+
+// The argv parser is a thin layer translating a CLI invocation into Options
+type config struct {
+	optSet *getopt.Set
+
+	//
+	// Bulk of CLI options definition starts here, the rest further down in initArgvParser()
+	//
+
+	Help            bool `getopt:"-h --help         Display basic help"`
+	HelpAll         bool `getopt:"--help-all        Display full help including options for every currently supported chunker/collector"`
+	MultipartStream bool `getopt:"--multipart       Expect multiple SInt64BE-size-prefixed streams on stdIN"`
+
+	emittersStdErr []string    // Emitter spec: option/helptext in initArgvParser()
+	emittersStdOut []string    // Emitter spec: option/helptext in initArgvParser()
+	emitTo         emitTargets // Emitter spec: option/helptext in initArgvParser()
+
+	// destinations opened on behalf of the emitters, closed on Destroy()
+	openedFiles []*os.File
+
+	// no-option-attached, these are instantiation error accumulators
+	erroredChunkers   []string
+	erroredCollectors []string
+
+	AsyncHashersCount  int `getopt:"--async-hashers=integer         Number of concurrent goroutines performing hashing. Set to 0 (disable) for predictable single-threaded benchmarking. Default:"`
+	RingBufferSize     int `getopt:"--ring-buffer-size=bytes        The size of the quantized ring buffer used for ingestion. Default:"`
+	RingBufferSectSize int `getopt:"--ring-buffer-sync-size=bytes   (EXPERT SETTING) The size of each buffer synchronization sector. Default:"` // option vaguely named 'sync' to not confuse users
+	RingBufferMinRead  int `getopt:"--ring-buffer-min-sysread=bytes (EXPERT SETTING) Perform next read(2) only when the specified amount of free space is available in the buffer. Default:"`
+
+	StatsActive uint `getopt:"--stats-active=uint   A bitfield representing activated stat aggregations: bit0:BlockSizing, bit1:RingbufferTiming. Default:"`
+
+	requestedChunkers   string // Chunker chain: option/helptext in initArgvParser()
+	requestedCollectors string // Collector chain: option/helptext in initArgvParser()
+}
+
+// the CLI-only "disable" emitter
+const emNone = "none"
+
+// not defaults but rather the list of known/configured emitters
+var availableEmitters = map[string]struct{}{
+	emNone:            {},
+	EmitterStatsText:  {},
+	EmitterStatsJsonl: {},
+	EmitterRootsJsonl: {},
+}
+
+// emitTargets accumulates repeated --emit-to options. Unlike a plain []string
+// option no comma-splitting takes place, as paths may contain commas.
+type emitTargets []string
+
+func (et *emitTargets) Set(value string, _ getopt.Option) error {
+	if value == "" {
+		*et = nil
+	} else {
+		*et = append(*et, value)
+	}
+	return nil
+}
+func (et *emitTargets) String() string { return strings.Join(*et, " ") }
+
+// ArgvError is returned by NewFromArgv when help was requested, or when the
+// supplied argv does not amount to a valid configuration. CLI wrappers are
+// expected to render it via PrintUsage().
+type ArgvError struct {
+	HelpRequested bool
+	Problems      []string
+
+	cfg *config
+}
+
+func (e *ArgvError) Error() string {
+	if e.HelpRequested {
+		return "help requested"
+	}
+	return "error parsing arguments:\n\t" + strings.Join(e.Problems, "\n\t")
+}
+
+// PrintUsage renders the CLI help, followed by the list of problems if any
+func (e *ArgvError) PrintUsage(out io.Writer) {
+
+	if len(e.Problems) > 0 {
+		fmt.Fprint(out, "\nFatal error parsing arguments:\n\n")
+	}
+
+	e.cfg.printUsage(out)
+
+	if len(e.Problems) > 0 {
+		fmt.Fprintf(
+			out,
+			"Fatal error parsing arguments:\n\t%s\n",
+			strings.Join(e.Problems, "\n\t"),
+		)
+	}
+}
+
+// ExitCode is the conventional exit status for a CLI wrapper: 0 when help
+// was requested, 2 on invalid arguments
+func (e *ArgvError) ExitCode() int {
+	if e.HelpRequested {
+		return 0
+	}
+	return 2
+}
+
+// NewFromArgv returns a Dagger configured from a CLI invocation
+func NewFromArgv(argv []string) (dgr *Dagger, err error) {
+	dgr, _, err = newFromArgv(argv, "")
+	return
+}
+
+// NewFromArgvWithInputs is NewFromArgv for CLI wrappers taking free-form
+// parameters after the options, typically input file names, which are
+// returned as inputs. The parameters string is rendered in the usage text.
+func NewFromArgvWithInputs(argv []string, parameters string) (dgr *Dagger, inputs []string, err error) {
+	return newFromArgv(argv, parameters)
+}
+
+func newFromArgv(argv []string, parameters string) (dgr *Dagger, inputs []string, err error) {
+
+	defaults := DefaultOptions()
+
+	cfg := &config{
+		AsyncHashersCount:  defaults.AsyncHashersCount,
+		StatsActive:        defaults.StatsActive,
+		RingBufferSize:     defaults.RingBufferSize,
+		RingBufferMinRead:  defaults.RingBufferMinRead,
+		RingBufferSectSize: defaults.RingBufferSectSize,
+
+		emittersStdOut: []string{EmitterRootsJsonl},
+		emittersStdErr: []string{EmitterStatsText},
+	}
+	if err := cfg.initArgvParser(parameters); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			for _, fh := range cfg.openedFiles {
+				fh.Close()
+			}
+		}
+	}()
+
+	// accumulator for multiple errors, to present to the user all at once
+	var argParseErrs []string
+	if parameters == "" {
+		argParseErrs = argparser.Parse(argv, cfg.optSet)
+	} else {
+		argParseErrs = argparser.ParseWithParameters(argv, cfg.optSet)
+		inputs = cfg.optSet.Args()
+	}
+
+	if cfg.Help || cfg.HelpAll {
+		return nil, nil, &ArgvError{HelpRequested: true, cfg: cfg}
+	}
+
+	opts := Options{
+		MultipartStream:    cfg.MultipartStream,
+		AsyncHashersCount:  cfg.AsyncHashersCount,
+		RingBufferSize:     cfg.RingBufferSize,
+		RingBufferSectSize: cfg.RingBufferSectSize,
+		RingBufferMinRead:  cfg.RingBufferMinRead,
+		StatsActive:        cfg.StatsActive,
+	}
+
+	var errs []string
+	opts.Collectors, errs = cfg.parseCollectorChain()
+	argParseErrs = append(argParseErrs, errs...)
+
+	// commP is very special, its sub-options only select the chunk size
+	if len(opts.Collectors) == 1 {
+		if cpCfg, isCommP := opts.Collectors[0].(FilCommPCollector); isCommP {
+			requiredChunker := fmt.Sprintf("fixed-size_%d", cpCfg.RequiredChunkSize())
+			if cfg.requestedChunkers == "" {
+				cfg.requestedChunkers = requiredChunker
+			}
+			if cfg.requestedChunkers != requiredChunker {
+				argParseErrs = append(argParseErrs, fmt.Sprintf(
+					"fil-commP requires a specific chunkers spec of '%s'",
+					requiredChunker,
+				))
+			}
+		}
+	}
+
+	opts.Chunkers, errs = cfg.parseChunkerChain()
+	argParseErrs = append(argParseErrs, errs...)
+	opts.Emitters, errs = cfg.parseEmitters()
+	argParseErrs = append(argParseErrs, errs...)
+
+	if len(argParseErrs) == 0 {
+		if dgr, err = New(opts); err != nil {
+			oErr, isOptsErr := err.(*OptionsError)
+			if !isOptsErr {
+				return nil, nil, err
+			}
+			cfg.erroredChunkers = append(cfg.erroredChunkers, oErr.erroredChunkers...)
+			cfg.erroredCollectors = append(cfg.erroredCollectors, oErr.erroredCollectors...)
+			argParseErrs = append(argParseErrs, oErr.Problems...)
+		}
+	}
+
+	if len(argParseErrs) != 0 {
+		sort.Strings(argParseErrs)
+		return nil, nil, &ArgvError{Problems: argParseErrs, cfg: cfg}
+	}
+
+	dgr.ownedFiles = cfg.openedFiles
+
+	// Opts *still* check out - take a snapshot of what we ended up with
+	dgr.statSummary.SysStats.ArgvInitial = make([]string, len(argv)-1-len(inputs))
+	copy(dgr.statSummary.SysStats.ArgvInitial, argv[1:])
+
+	// All cid-determining opt come last in a predefined order
+	cidOpts := []string{
+		"chunkers",
+		"collectors",
+	}
+	cidOptsIdx := map[string]struct{}{}
+	for _, n := range cidOpts {
+		cidOptsIdx[n] = struct{}{}
+	}
+
+	// first do the generic options
+	cfg.optSet.VisitAll(func(o getopt.Option) {
+		switch o.LongName() {
+		case "help", "help-all", "ipfs-add-compatible-command":
+			// do nothing for these
+		default:
+			// skip these keys too, they come next
+			if _, exists := cidOptsIdx[o.LongName()]; !exists {
+				dgr.statSummary.SysStats.ArgvExpanded = append(
+					dgr.statSummary.SysStats.ArgvExpanded, fmt.Sprintf(`--%s=%s`,
+						o.LongName(),
+						o.Value().String(),
+					),
+				)
+			}
+		}
+	})
+	sort.Strings(dgr.statSummary.SysStats.ArgvExpanded)
+
+	// now do the remaining cid-determining options
+	for _, n := range cidOpts {
+		dgr.statSummary.SysStats.ArgvExpanded = append(
+			dgr.statSummary.SysStats.ArgvExpanded, fmt.Sprintf(`--%s=%s`,
+				n,
+				cfg.optSet.GetValue(n),
+			),
+		)
+	}
+
+	return
+}
+
+func (cfg *config) printUsage(out io.Writer) {
+	cfg.optSet.PrintUsage(out)
+	if cfg.HelpAll || len(cfg.erroredChunkers) > 0 || len(cfg.erroredCollectors) > 0 {
+		printPluginUsage(
+			out,
+			cfg.erroredCollectors,
+			cfg.erroredChunkers,
+		)
+	} else {
+		fmt.Fprint(out, "\nTry --help-all for more info\n\n")
+	}
+}
+
+func printPluginUsage(
+	out io.Writer,
+	listCollectors []string,
+	listChunkers []string,
+) {
+
+	// if nothing was requested explicitly - list everything
+	if len(listCollectors) == 0 && len(listChunkers) == 0 {
+		for name, parser := range availableCollectors {
+			if parser != nil {
+				listCollectors = append(listCollectors, name)
+			}
+		}
+		for name, parser := range availableChunkers {
+			if parser != nil {
+				listChunkers = append(listChunkers, name)
+			}
+		}
+	}
+
+	if len(listCollectors) != 0 {
+		fmt.Fprint(out, "\n")
+		sort.Strings(listCollectors)
+		for _, name := range listCollectors {
+			fmt.Fprintf(
+				out,
+				"[C]ollector '%s'\n",
+				name,
+			)
+			_, h := availableCollectors[name](nil)
+			if len(h) == 0 {
+				fmt.Fprint(out, "  -- no helptext available --\n\n")
+			} else {
+				fmt.Fprintln(out, strings.Join(h, "\n"))
+			}
+		}
+	}
+
+	if len(listChunkers) != 0 {
+		fmt.Fprint(out, "\n")
+		sort.Strings(listChunkers)
+		for _, name := range listChunkers {
+			fmt.Fprintf(
+				out,
+				"[C]hunker '%s'\n",
+				name,
+			)
+			_, h := availableChunkers[name](nil)
+			if len(h) == 0 {
+				fmt.Fprint(out, "  -- no helptext available --\n\n")
+			} else {
+				fmt.Fprintln(out, strings.Join(h, "\n"))
+			}
+		}
+	}
+
+	fmt.Fprint(out, "\n")
+}
+
+func (cfg *config) initArgvParser(parameters string) error {
+	// The default documented way of using pborman/options is to muck with globals
+	// Operate over objects instead, allowing us to re-parse argv multiple times
+	o := getopt.New()
+	if err := options.RegisterSet("", cfg, o); err != nil {
+		return fmt.Errorf("option set registration failed: %s", err)
+	}
+	cfg.optSet = o
+
+	// unless the wrapper takes freeform args
+	// need to override this for sensible help render
+	o.SetParameters(parameters)
+
+	// Several options have the help-text assembled programmatically
+	o.FlagLong(&cfg.requestedChunkers, "chunkers", 0,
+		"Stream chunking algorithm chain. Each chunker is one of: "+text.AvailableMapKeys(availableChunkers),
+		"ch1_o1.1_o1.2_..._o1.N__ch2_o2.1_o2.2_..._o2.N__ch3_...",
+	)
+	o.FlagLong(&cfg.requestedCollectors, "collectors", 0,
+		"Node-forming algorithm chain. Each collector is one of: "+text.AvailableMapKeys(availableCollectors),
+		"co1_o1.1_o1.2_..._o1.N__co2_...",
+	)
+	o.FlagLong(&cfg.emittersStdErr, "emit-stderr", 0, fmt.Sprintf(
+		"One or more emitters to activate on stdERR. Available emitters are %s. Default: ",
+		text.AvailableMapKeys(availableEmitters),
+	), "comma,sep,emitters")
+	o.FlagLong(&cfg.emittersStdOut, "emit-stdout", 0,
+		"One or more emitters to activate on stdOUT. Available emitters same as above. Default: ",
+		"comma,sep,emitters",
+	)
+	o.FlagLong(&cfg.emitTo, "emit-to", 0,
+		"Route an emitter to a file (truncated if it exists) or to an already open file descriptor 'fd:N'. "+
+			"Can be repeated. Emitters routed this way are removed from the --emit-stdout/--emit-stderr defaults",
+		"emitter:path",
+	)
+
+	return nil
+}
+
+func (cfg *config) parseEmitters() (emitters map[string]io.Writer, argErrs []string) {
+
+	emitters = make(map[string]io.Writer, len(availableEmitters))
+
+	// pass 1: explicitly routed emitters
+	routed := make(map[string]bool, len(cfg.emitTo))
+	fileDestinations := make(map[string]*os.File, len(cfg.emitTo))
+	for _, spec := range cfg.emitTo {
+
+		sep := strings.IndexByte(spec, ':')
+		if sep < 1 || sep == len(spec)-1 {
+			argErrs = append(argErrs, fmt.Sprintf("invalid --emit-to spec '%s', expecting 'emitter:path' or 'emitter:fd:N'", spec))
+			continue
+		}
+		em, dest := spec[:sep], spec[sep+1:]
+
+		if _, exists := availableEmitters[em]; !exists || em == emNone {
+			argErrs = append(argErrs, fmt.Sprintf("invalid emitter '%s' specified for --emit-to. Available emitters are: %s",
+				em,
+				text.AvailableMapKeys(availableEmitters),
+			))
+			continue
+		} else if emitters[em] != nil {
+			argErrs = append(argErrs, fmt.Sprintf("Emitter '%s' specified more than once", em))
+			continue
+		}
+
+		fh, err := cfg.openEmitterDestination(dest, fileDestinations)
+		if err != nil {
+			argErrs = append(argErrs, fmt.Sprintf("Unable to open destination of emitter '%s': %s", em, err))
+			continue
+		}
+
+		emitters[em] = fh
+		routed[em] = true
+	}
+
+	// explicitly routed emitters are not subject to the defaults
+	if !cfg.optSet.IsSet("emit-stderr") {
+		cfg.emittersStdErr = withoutEmitters(cfg.emittersStdErr, emitters)
+	}
+	if !cfg.optSet.IsSet("emit-stdout") {
+		cfg.emittersStdOut = withoutEmitters(cfg.emittersStdOut, emitters)
+	}
+
+	// pass 2: the standard streams
+
+	activeStderr := make(map[string]bool, len(cfg.emittersStdErr))
+	for _, s := range cfg.emittersStdErr {
+		activeStderr[s] = true
+		if _, exists := availableEmitters[s]; !exists {
+			argErrs = append(argErrs, fmt.Sprintf("invalid emitter '%s' specified for --emit-stderr. Available emitters are: %s",
+				s,
+				text.AvailableMapKeys(availableEmitters),
+			))
+		} else if s == emNone {
+			continue
+		} else if emitters[s] != nil {
+			argErrs = append(argErrs, fmt.Sprintf("Emitter '%s' specified more than once", s))
+		} else {
+			emitters[s] = os.Stderr
+		}
+	}
+	activeStdout := make(map[string]bool, len(cfg.emittersStdOut))
+	for _, s := range cfg.emittersStdOut {
+		activeStdout[s] = true
+		if _, exists := availableEmitters[s]; !exists {
+			argErrs = append(argErrs, fmt.Sprintf("invalid emitter '%s' specified for --emit-stdout. Available emitters are: %s",
+				s,
+				text.AvailableMapKeys(availableEmitters),
+			))
+		} else if s == emNone {
+			continue
+		} else if emitters[s] != nil {
+			argErrs = append(argErrs, fmt.Sprintf("Emitter '%s' specified more than once", s))
+		} else {
+			emitters[s] = os.Stdout
+		}
+	}
+
+	for _, exclusiveEmitter := range []string{
+		emNone,
+		EmitterStatsText,
+	} {
+		if activeStderr[exclusiveEmitter] && len(activeStderr) > 1 {
+			argErrs = append(argErrs, fmt.Sprintf(
+				"When specified, emitter '%s' must be the sole argument to --emit-stderr",
+				exclusiveEmitter,
+			))
+		}
+		if activeStdout[exclusiveEmitter] && len(activeStdout) > 1 {
+			argErrs = append(argErrs, fmt.Sprintf(
+				"When specified, emitter '%s' must be the sole argument to --emit-stdout",
+				exclusiveEmitter,
+			))
+		}
+	}
+
+	// stats-text can not share a destination with anything, including the
+	// standard streams (those are already checked above)
+	if textOut := emitters[EmitterStatsText]; textOut != nil {
+		for em, w := range emitters {
+			if w == textOut && em != EmitterStatsText && (routed[em] || routed[EmitterStatsText]) {
+				argErrs = append(argErrs, fmt.Sprintf(
+					"Emitter '%s' can not share its --emit-to destination with emitter '%s'",
+					EmitterStatsText,
+					em,
+				))
+			}
+		}
+	}
+
+	// write hints are entirely opportunistic: failures are of no consequence
+	for _, w := range emitters {
+		if fh, isFile := w.(*os.File); isFile {
+			if stat, err := fh.Stat(); err == nil {
+				for _, opt := range stream.WriteOptimizations {
+					opt.Action(fh, stat) // nolint:errcheck
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// openEmitterDestination resolves an --emit-to destination, reusing handles
+// for destinations shared between several emitters
+func (cfg *config) openEmitterDestination(dest string, opened map[string]*os.File) (*os.File, error) {
+
+	if fh, exists := opened[dest]; exists {
+		return fh, nil
+	}
+
+	var fh *os.File
+	if strings.HasPrefix(dest, "fd:") {
+		fd, err := strconv.ParseUint(dest[3:], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file descriptor '%s'", dest[3:])
+		}
+
+		switch fd {
+		case 1:
+			fh = os.Stdout
+		case 2:
+			fh = os.Stderr
+		default:
+			fh = os.NewFile(uintptr(fd), dest)
+		}
+
+		if _, err := fh.Stat(); err != nil {
+			return nil, fmt.Errorf("file descriptor %d is not usable: %s", fd, err)
+		}
+	} else {
+		var err error
+		if fh, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			return nil, err
+		}
+		cfg.openedFiles = append(cfg.openedFiles, fh)
+	}
+
+	opened[dest] = fh
+	return fh, nil
+}
+
+func withoutEmitters(list []string, exclude map[string]io.Writer) (remaining []string) {
+	for _, em := range list {
+		if exclude[em] == nil {
+			remaining = append(remaining, em)
+		}
+	}
+	return
+}
+
+func (cfg *config) parseChunkerChain() (chain []ChunkerConfig, argErrs []string) {
+
+	// bail early
+	if cfg.requestedChunkers == "" {
+		return nil, []string{
+			"You must specify at least one stream chunker via '--chunkers=algname1_opt1_opt2__algname2_...'. Available chunker names are: " +
+				text.AvailableMapKeys(availableChunkers),
+		}
+	}
+
+	for _, chunkerCmd := range strings.Split(cfg.requestedChunkers, "__") {
+		chunkerArgs := strings.Split(chunkerCmd, "_")
+		parser, exists := availableChunkers[chunkerArgs[0]]
+		if !exists {
+			argErrs = append(argErrs, fmt.Sprintf(
+				"Chunker '%s' not found. Available chunker names are: %s",
+				chunkerArgs[0],
+				text.AvailableMapKeys(availableChunkers),
+			))
+			continue
+		}
+
+		for n := range chunkerArgs {
+			if n > 0 {
+				chunkerArgs[n] = "--" + chunkerArgs[n]
+			}
+		}
+
+		if chunkerCfg, initErrors := parser(chunkerArgs); len(initErrors) > 0 {
+			cfg.erroredChunkers = append(cfg.erroredChunkers, chunkerArgs[0])
+			for _, e := range initErrors {
+				argErrs = append(argErrs, fmt.Sprintf(
+					"Initialization of chunker '%s' failed: %s",
+					chunkerArgs[0],
+					e,
+				))
+			}
+		} else {
+			chain = append(chain, chunkerCfg)
+		}
+	}
+
+	return
+}
+
+func (cfg *config) parseCollectorChain() (chain []CollectorConfig, argErrs []string) {
+
+	// bail early
+	if cfg.optSet.IsSet("collectors") && cfg.requestedCollectors == "" {
+		return nil, []string{
+			"When specified, collector chain must be in the form '--collectors=algname1_opt1_opt2__algname2_...'. Available collector names are: " +
+				text.AvailableMapKeys(availableCollectors),
+		}
+	}
+
+	for _, collectorCmd := range strings.Split(cfg.requestedCollectors, "__") {
+
+		collectorArgs := strings.Split(collectorCmd, "_")
+		parser, exists := availableCollectors[collectorArgs[0]]
+		if !exists {
+			argErrs = append(argErrs, fmt.Sprintf(
+				"Collector '%s' not found. Available collector names are: %s",
+				collectorArgs[0],
+				text.AvailableMapKeys(availableCollectors),
+			))
+			continue
+		}
+
+		for n := range collectorArgs {
+			if n > 0 {
+				collectorArgs[n] = "--" + collectorArgs[n]
+			}
+		}
+
+		if collectorCfg, initErrors := parser(collectorArgs); len(initErrors) > 0 {
+			cfg.erroredCollectors = append(cfg.erroredCollectors, collectorArgs[0])
+			for _, e := range initErrors {
+				argErrs = append(argErrs, fmt.Sprintf(
+					"Initialization of collector '%s' failed: %s",
+					collectorArgs[0],
+					e,
+				))
+			}
+		} else {
+			chain = append(chain, collectorCfg)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,213 @@
+package dagger_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ribasushi/fil-discover-check/dagger"
+)
+
+func TestNewFromArgvErrors(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir("", "dagger-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for name, tc := range map[string]struct {
+		argv     []string
+		exitCode int
+	}{
+		"help":               {[]string{"--help"}, 0},
+		"unknown option":     {[]string{"--no-such-option"}, 2},
+		"unknown collector":  {[]string{"--collectors=no-such-collector"}, 2},
+		"commP chunker":      {[]string{"--collectors=fil-commP", "--chunkers=fixed-size_5"}, 2},
+		"unknown emitter":    {[]string{"--emit-stdout=no-such-emitter"}, 2},
+		"invalid emit-to":    {[]string{"--emit-to=roots-jsonl"}, 2},
+		"unopenable emit-to": {[]string{"--emit-to=roots-jsonl:" + filepath.Join(tmpDir, "missing", "roots")}, 2},
+	} {
+		dgr, err := dagger.NewFromArgv(append([]string{"dagger"}, tc.argv...))
+		if dgr != nil {
+			dgr.Destroy()
+			t.Errorf("%s: returned an instance", name)
+		}
+
+		var argErr *dagger.ArgvError
+		if !errors.As(err, &argErr) {
+			t.Errorf("%s: expected an ArgvError, got %v", name, err)
+			continue
+		}
+		if argErr.ExitCode() != tc.exitCode {
+			t.Errorf("%s: expected exit code %d, got %d", name, tc.exitCode, argErr.ExitCode())
+		}
+		if argErr.HelpRequested != (tc.exitCode == 0) || (len(argErr.Problems) == 0) == (tc.exitCode != 0) {
+			t.Errorf("%s: inconsistent %#v", name, argErr)
+		}
+
+		var usage bytes.Buffer
+		argErr.PrintUsage(&usage)
+		if usage.Len() == 0 {
+			t.Errorf("%s: empty usage", name)
+		}
+	}
+}
+
+func TestNewFromArgv(t *testing.T) {
+
+	dgr, err := dagger.NewFromArgv([]string{"dagger", "--collectors=fil-commP", "--emit-stdout=none", "--emit-stderr=none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dgr.Destroy()
+
+	if _, err := dgr.ProcessReader(bytes.NewReader(testPayload(1000))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runArgv processes payload and outputs the summary with a Dagger configured
+// from args, returning whatever was written to stdOUT and stdERR
+func runArgv(t *testing.T, args []string, payload []byte) (stdout, stderr string) {
+
+	tmpDir, err := ioutil.TempDir("", "dagger-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	origStdout, origStderr := os.Stdout, os.Stderr
+	defer func() { os.Stdout, os.Stderr = origStdout, origStderr }()
+	if os.Stdout, err = os.Create(filepath.Join(tmpDir, "stdout")); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Stdout.Close()
+	if os.Stderr, err = os.Create(filepath.Join(tmpDir, "stderr")); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Stderr.Close()
+
+	dgr, err := dagger.NewFromArgv(append([]string{"dagger", "--collectors=fil-commP"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dgr.ProcessReader(bytes.NewReader(payload))
+	if err == nil {
+		err = dgr.OutputSummary()
+	}
+	dgr.Destroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := ioutil.ReadFile(os.Stdout.Name())
+	errOut, _ := ioutil.ReadFile(os.Stderr.Name())
+	return string(out), string(errOut)
+}
+
+func TestEmitTo(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir("", "dagger-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	roots, stats, shared := filepath.Join(tmpDir, "roots"), filepath.Join(tmpDir, "stats"), filepath.Join(tmpDir, "shared")
+
+	payload := testPayload(1000)
+	res, err := newDagger(t, commPOptions(0)).ProcessReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootsLine := `"cid":"` + res[0].Cid.String() + `"`
+
+	// roots-jsonl leaves the stdOUT default, stats-text remains on stdERR
+	stdout, stderr := runArgv(t, []string{"--emit-to=roots-jsonl:" + roots, "--emit-to=stats-jsonl:" + stats}, payload)
+	if stdout != "" || stderr == "" || strings.HasPrefix(stderr, "{") {
+		t.Errorf("separate destinations: unexpected stdOUT %q and stdERR %q", stdout, stderr)
+	}
+	if out, _ := ioutil.ReadFile(roots); strings.Count(string(out), "\n") != 1 || !strings.Contains(string(out), rootsLine) {
+		t.Errorf("separate destinations: unexpected roots %q", out)
+	}
+	if out, _ := ioutil.ReadFile(stats); strings.Count(string(out), "\n") != 1 || !strings.Contains(string(out), `"event":"summary"`) {
+		t.Errorf("separate destinations: unexpected stats %q", out)
+	}
+
+	// a shared destination, and stats-text routed away from stdERR
+	stdout, stderr = runArgv(t, []string{"--emit-to=roots-jsonl:" + shared, "--emit-to=stats-jsonl:" + shared, "--emit-to=stats-text:" + stats}, payload)
+	if stdout != "" || stderr != "" {
+		t.Errorf("shared destination: unexpected stdOUT %q and stdERR %q", stdout, stderr)
+	}
+	out, _ := ioutil.ReadFile(shared)
+	if lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"); len(lines) != 2 || !strings.Contains(lines[0], rootsLine) || !strings.Contains(lines[1], `"event":"summary"`) {
+		t.Errorf("shared destination: unexpected contents %q", out)
+	}
+	if out, _ := ioutil.ReadFile(stats); len(out) == 0 || out[0] == '{' {
+		t.Errorf("shared destination: unexpected stats-text %q", out)
+	}
+}
+
+func TestNewOptionsError(t *testing.T) {
+
+	opts := commPOptions(0)
+	opts.Chunkers = []dagger.ChunkerConfig{dagger.FixedSizeChunker{Size: 5}}
+	opts.Emitters = map[string]io.Writer{"no-such-emitter": ioutil.Discard}
+
+	dgr, err := dagger.New(opts)
+	if dgr != nil {
+		dgr.Destroy()
+		t.Error("returned an instance")
+	}
+	var optsErr *dagger.OptionsError
+	if !errors.As(err, &optsErr) {
+		t.Fatalf("expected an OptionsError, got %v", err)
+	}
+	if len(optsErr.Problems) != 2 {
+		t.Errorf("expected both the chunker and the emitter reported, got %q", optsErr.Problems)
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errWrite }
+
+func TestEmissionErrors(t *testing.T) {
+
+	for _, emitter := range []string{dagger.EmitterRootsJsonl, dagger.EmitterStatsJsonl, dagger.EmitterStatsText} {
+		opts := commPOptions(0)
+		opts.Emitters = map[string]io.Writer{emitter: failingWriter{}}
+		dgr := newDagger(t, opts)
+
+		_, err := dgr.ProcessReader(bytes.NewReader(testPayload(1000)))
+		if emitter == dagger.EmitterRootsJsonl {
+			// roots are emitted as they are found
+			assertEmissionError(t, err, emitter)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", emitter, err)
+		}
+		assertEmissionError(t, dgr.OutputSummary(), emitter)
+	}
+}
+
+func assertEmissionError(t *testing.T, err error, emitter string) {
+	t.Helper()
+
+	var emErr *dagger.EmissionError
+	if !errors.As(err, &emErr) {
+		t.Errorf("%s: expected an EmissionError, got %v", emitter, err)
+		return
+	}
+	if emErr.Emitter != emitter || !errors.Is(err, errWrite) {
+		t.Errorf("%s: unexpected %#v", emitter, emErr)
+	}
+}
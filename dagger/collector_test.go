@@ -0,0 +1,84 @@
+package dagger_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ribasushi/fil-discover-check/commp"
+	"github.com/ribasushi/fil-discover-check/dagger"
+	"github.com/ribasushi/fil-discover-check/fr32"
+)
+
+func TestDeclaredPieceSize(t *testing.T) {
+
+	for _, size := range []int{127, 1000, 1<<20 + 3} {
+		payload := testPayload(size)
+		natural := uint64(128)
+		for natural/128*127 < uint64(size) {
+			natural *= 2
+		}
+
+		for _, declared := range []uint64{natural, 2 * natural, 8 * natural} {
+			opts := commPOptions(1)
+			opts.Collectors = []dagger.CollectorConfig{dagger.FilCommPCollector{PaddedPieceSize: declared}}
+			res, err := newDagger(t, opts).ProcessReader(bytes.NewReader(payload))
+			if err != nil {
+				t.Fatalf("%d bytes in %d: %s", size, declared, err)
+			}
+
+			// the commitment of the payload followed by zeroes up to the
+			// declared size
+			extended := make([]byte, declared/128*127)
+			copy(extended, payload)
+			want, _ := commp.PieceCID(naiveCommP(extended))
+			if !res[0].Cid.Equals(want) || res[0].PaddedPieceSize != declared || res[0].PayloadSize != uint64(size) {
+				t.Errorf("%d bytes in %d: got %s/%d/%d, expected %s/%d/%d", size, declared, res[0].Cid, res[0].PaddedPieceSize, res[0].PayloadSize, want, declared, size)
+			}
+		}
+
+		if natural > 128 {
+			opts := commPOptions(1)
+			opts.Collectors = []dagger.CollectorConfig{dagger.FilCommPCollector{PaddedPieceSize: natural / 2}}
+			if _, err := newDagger(t, opts).ProcessReader(bytes.NewReader(payload)); err == nil {
+				t.Errorf("%d bytes accepted in a %d byte piece", size, natural/2)
+			}
+		}
+	}
+}
+
+func TestPrePadded(t *testing.T) {
+
+	prePadded := commPOptions(1)
+	prePadded.Collectors = []dagger.CollectorConfig{dagger.FilCommPCollector{PrePadded: true}}
+	dgr := newDagger(t, prePadded)
+
+	// payloads of whole quanta: padded input always unpads to such
+	for _, size := range []int{127, 127 * 1000, 127*(1<<15) + 127*3} {
+		payload := testPayload(size)
+		want, err := newDagger(t, commPOptions(1)).ProcessReader(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := dgr.ProcessReader(bytes.NewReader(fr32.Pad(payload)))
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if !res[0].Cid.Equals(want[0].Cid) || res[0].PayloadSize != want[0].PayloadSize || res[0].PaddedPieceSize != want[0].PaddedPieceSize {
+			t.Errorf("%d bytes: padded input gave %s/%d, expected %s/%d", size, res[0].Cid, res[0].PayloadSize, want[0].Cid, want[0].PayloadSize)
+		}
+	}
+
+	// a leaf in the first chunk, and one well past it
+	padded := fr32.Pad(testPayload(127 * (1 << 15)))
+	for _, leaf := range []int{5, 100000} {
+		corrupt := append([]byte{}, padded...)
+		corrupt[leaf*32+31] = 0xC0
+		_, err := dgr.ProcessReader(bytes.NewReader(corrupt))
+		if expected := fmt.Sprintf("leaf at offset %d (leaf #%d)", leaf*32, leaf); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("leaf #%d: expected an error reporting the %s, got %v", leaf, expected, err)
+		}
+	}
+}
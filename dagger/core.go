@@ -0,0 +1,107 @@
+package dagger
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ipfs/go-qringbuf"
+	"github.com/ribasushi/fil-discover-check/internal/constants"
+	dgrblock "github.com/ribasushi/fil-discover-check/internal/dagger/block"
+
+	"github.com/ribasushi/fil-discover-check/chunker"
+	dgrchunker "github.com/ribasushi/fil-discover-check/internal/dagger/chunker"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/chunker/fixedsize"
+
+	dgrcollector "github.com/ribasushi/fil-discover-check/internal/dagger/collector"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/collector/filcommp"
+)
+
+var availableChunkers = map[string]dgrchunker.ArgParser{
+	"fixed-size": fixedsize.ParseArgs,
+}
+var availableCollectors = map[string]dgrcollector.ArgParser{
+	"fil-commP": filcommp.ParseArgs,
+}
+
+type dgrChunkerUnit struct {
+	_         constants.Incomparabe
+	instance  chunker.Chunker
+	constants dgrchunker.InstanceConstants
+}
+
+type carUnit struct {
+	_      constants.Incomparabe
+	hdr    *dgrblock.Header
+	region *qringbuf.Region
+}
+
+// Dagger ingests streams one at a time. See ProcessReader for the details of
+// reusing a single instance, and Pool for processing streams concurrently.
+type Dagger struct {
+	// speederization shortcut flags for internal logic
+	generateRoots bool
+
+	curStreamOffset   int64
+	cfg               Options
+	statSummary       statSummary
+	chainedChunkers   []dgrChunkerUnit
+	chainedCollectors []dgrcollector.Collector
+	shutdownSemaphore chan struct{}
+	shutdownWG        sync.WaitGroup
+	qrb               *qringbuf.QuantizedRingBuffer
+	qrbReader         *swappableReader
+	asyncWG           sync.WaitGroup
+	mu                sync.Mutex
+	busy              bool
+	seenRoots         seenRoots
+	ownedFiles        []*os.File // emitter destinations opened by NewFromArgv
+}
+
+// swappableReader allows a single ring buffer to be fed from a succession of
+// independent readers
+type swappableReader struct {
+	io.Reader
+}
+
+// Destroy terminates all background goroutines of the instance, closes any
+// emitter destinations opened by NewFromArgv and releases its ring buffer.
+// The instance can not be used afterwards.
+func (dgr *Dagger) Destroy() {
+
+	dgr.mu.Lock()
+	if dgr.shutdownSemaphore != nil {
+		close(dgr.shutdownSemaphore)
+		dgr.shutdownSemaphore = nil
+	}
+	dgr.qrb = nil
+	dgr.qrbReader = nil
+	for _, fh := range dgr.ownedFiles {
+		fh.Close()
+	}
+	dgr.ownedFiles = nil
+	dgr.mu.Unlock()
+
+	dgr.shutdownWG.Wait()
+}
+
+func (dgr *Dagger) claim() error {
+	dgr.mu.Lock()
+	defer dgr.mu.Unlock()
+
+	if dgr.shutdownSemaphore == nil {
+		return errors.New("use of a destroyed Dagger instance")
+	} else if dgr.busy {
+		return errors.New("concurrent use of a Dagger instance, consider using a Pool")
+	}
+
+	dgr.busy = true
+	return nil
+}
+
+func (dgr *Dagger) release() {
+	dgr.mu.Lock()
+	dgr.busy = false
+	dgr.mu.Unlock()
+}
@@ -0,0 +1,52 @@
+// +build !tinygo
+
+package dagger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+func (smr *statSummary) writeAsJSON(writeTo io.Writer) error {
+
+	// because the golang json encoder is rather garbage
+	if smr.Roots == nil {
+		smr.Roots = []rootStats{}
+	}
+
+	jsonl, err := json.Marshal(smr)
+	if err != nil {
+		return &EmissionError{Emitter: EmitterStatsJsonl, Err: fmt.Errorf("encoding stats failed: %s", err)}
+	}
+
+	if _, err := fmt.Fprintf(writeTo, "%s\n", jsonl); err != nil {
+		return &EmissionError{Emitter: EmitterStatsJsonl, Err: err}
+	}
+
+	return nil
+}
+
+func (rs rootStats) writeAsJSON(writeTo io.Writer) error {
+
+	jsonl, err := json.Marshal(struct {
+		EventType string `json:"event"`
+		rootStats
+	}{"root", rs})
+	if err != nil {
+		return &EmissionError{Emitter: EmitterRootsJsonl, Err: fmt.Errorf("encoding root failed: %s", err)}
+	}
+
+	if _, err := fmt.Fprintf(writeTo, "%s\n", jsonl); err != nil {
+		return &EmissionError{Emitter: EmitterRootsJsonl, Err: err}
+	}
+
+	return nil
+}
+
+// https://github.com/tinygo-org/tinygo/issues/1285
+var tinygoWorkaroundNumCPU = runtime.NumCPU
+var tinygoWorkaroundGetpagesize = os.Getpagesize
+var tinygoWorkaroundGoVersion = runtime.Version
@@ -1,12 +1,16 @@
 package dagger
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-qringbuf"
+	"github.com/ribasushi/fil-discover-check/commp"
 	"github.com/ribasushi/fil-discover-check/internal/constants"
 	"github.com/ribasushi/fil-discover-check/internal/zcpstring"
 
@@ -22,21 +26,95 @@ const (
 	chunkQueueSizeSubchunk = 32
 )
 
-const (
-	ErrorString = IngestionEventType(iota)
-	NewRootJsonl
-)
+var preProcessTasks, postProcessTasks func(dgr *Dagger)
 
-type IngestionEvent struct {
-	_    constants.Incomparabe
-	Type IngestionEventType
-	Body string
+var errAborted = errors.New("stream processing aborted")
+
+// ctxReader fails every read once its context is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
 }
-type IngestionEventType int
 
-var preProcessTasks, postProcessTasks func(dgr *Dagger)
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// Result describes the root of a processed stream
+type Result struct {
+	// 1-based position of the substream within a MultipartStream input, 0
+	// otherwise
+	Substream int64
+	// Root CID of the stream, for fil-commP the piece CID
+	Cid cid.Cid
+	// Length of the stream
+	PayloadSize uint64
+	// Cumulative size of the resulting DAG, for fil-commP equal to
+	// PaddedPieceSize
+	DagSize uint64
+	// Padded size of the piece, only set by a fil-commP collector
+	PaddedPieceSize uint64
+	// The complete piece tree, only set by a fil-commP collector configured
+	// with RetainTree
+	PieceTree *commp.Tree
+}
 
-func (dgr *Dagger) ProcessReader(inputReader io.Reader) (commp []byte, err error) {
+// implemented by collectors able to retain the tree of the last flushed stream
+type treeRetainer interface {
+	TakeTree() *commp.Tree
+}
+
+// implemented by collectors whose flush can fail
+type flushFailer interface {
+	TakeFlushError() error
+}
+
+func newResult(rootBlock *dgrblock.Header) (*Result, error) {
+	c, err := cid.Cast(rootBlock.Cid())
+	if err != nil {
+		return nil, fmt.Errorf("collector produced an undecodeable root CID %x: %s", rootBlock.Cid(), err)
+	}
+	return &Result{
+		Cid:         c,
+		PayloadSize: rootBlock.SizeCumulativePayload(),
+		DagSize:     rootBlock.SizeCumulativeDag(),
+	}, nil
+}
+
+// ProcessReader ingests inputReader until EOF, returning the root of the
+// stream, or in MultipartStream mode the roots of every non-empty substream in
+// input order.
+//
+// A single Dagger may process any number of independent readers, one after
+// another. Every call starts from a clean slate: collector state, stream
+// offsets and the statistics reported by OutputSummary() are reset, while the
+// ring buffer memory is retained across calls. After a failed call the ring
+// buffer is discarded and reallocated on next use. Overlapping calls on the
+// same instance are rejected with an error: use a Pool instead.
+func (dgr *Dagger) ProcessReader(inputReader io.Reader) ([]*Result, error) {
+	return dgr.ProcessReaderContext(context.Background(), inputReader)
+}
+
+// ProcessReaderContext is ProcessReader with support for cancellation. Once
+// ctx is done no further reads are issued against inputReader, all in-flight
+// processing is shut down, and ctx.Err() is returned. A read already blocked
+// inside inputReader delays the return until that read completes.
+func (dgr *Dagger) ProcessReaderContext(ctx context.Context, inputReader io.Reader) (results []*Result, err error) {
+
+	if err := dgr.claim(); err != nil {
+		return nil, err
+	}
+	defer dgr.release()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		inputReader = &ctxReader{ctx: ctx, r: inputReader}
+	}
 
 	var t0 time.Time
 
@@ -62,7 +140,32 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader) (commp []byte, err error
 			postProcessTasks(dgr)
 		}
 
-		dgr.qrb = nil
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				err = ctxErr
+
+				// the reader is failing all reads by now: consume what is left
+				// to let the ring buffer collector terminate
+				if dgr.qrb != nil {
+					for {
+						if r, _ := dgr.qrb.NextRegion(0); r == nil {
+							break
+						}
+					}
+				}
+			}
+
+			// the ring buffer can not recover from a reader error, and the
+			// collectors may be holding a partial stream
+			dgr.qrb = nil
+			dgr.qrbReader = nil
+			for _, c := range dgr.chainedCollectors {
+				c.Reset()
+			}
+		} else {
+			// do not hold on to the caller's reader
+			dgr.qrbReader.Reader = nil
+		}
 
 		dgr.statSummary.SysStats.ElapsedNsecs = time.Since(t0).Nanoseconds()
 	}()
@@ -78,7 +181,7 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader) (commp []byte, err error
 			}
 
 			err = fmt.Errorf(
-				"failure at byte offset %s of sub-stream #%d with %s bytes buffered/unprocessed: %s",
+				"failure at byte offset %s of sub-stream #%d with %s bytes buffered/unprocessed: %w",
 				text.Commify64(dgr.curStreamOffset),
 				dgr.statSummary.Streams,
 				text.Commify(buffered),
@@ -87,24 +190,31 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader) (commp []byte, err error
 		}
 	}()
 
+	dgr.curStreamOffset = 0
+	dgr.statSummary.resetCounters()
+
 	if preProcessTasks != nil {
 		preProcessTasks(dgr)
 	}
 	t0 = time.Now()
 
-	dgr.qrb, err = qringbuf.NewFromReader(inputReader, qringbuf.Config{
-		// MinRegion must be twice the maxchunk, otherwise chunking chains won't work (hi, Claude Shannon)
-		MinRegion:   2 * constants.MaxLeafPayloadSize,
-		MinRead:     dgr.cfg.RingBufferMinRead,
-		MaxCopy:     2 * constants.MaxLeafPayloadSize, // SANCHECK having it equal to the MinRegion may be daft...
-		BufferSize:  dgr.cfg.RingBufferSize,
-		SectorSize:  dgr.cfg.RingBufferSectSize,
-		Stats:       &dgr.statSummary.SysStats.Stats,
-		TrackTiming: ((dgr.cfg.StatsActive & gatherStatsRingbuf) == gatherStatsRingbuf),
-	})
-	if err != nil {
-		return
+	if dgr.qrb == nil {
+		dgr.qrbReader = new(swappableReader)
+		dgr.qrb, err = qringbuf.NewFromReader(dgr.qrbReader, qringbuf.Config{
+			// MinRegion must be twice the maxchunk, otherwise chunking chains won't work (hi, Claude Shannon)
+			MinRegion:   2 * constants.MaxLeafPayloadSize,
+			MinRead:     dgr.cfg.RingBufferMinRead,
+			MaxCopy:     2 * constants.MaxLeafPayloadSize, // SANCHECK having it equal to the MinRegion may be daft...
+			BufferSize:  dgr.cfg.RingBufferSize,
+			SectorSize:  dgr.cfg.RingBufferSectSize,
+			Stats:       &dgr.statSummary.SysStats.Stats,
+			TrackTiming: ((dgr.cfg.StatsActive & GatherStatsRingbuf) == GatherStatsRingbuf),
+		})
+		if err != nil {
+			return
+		}
 	}
+	dgr.qrbReader.Reader = inputReader
 
 	// use 64bits everywhere
 	var substreamSize int64
@@ -130,21 +240,16 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader) (commp []byte, err error
 				)
 			}
 
+			// count empty substreams too, keeping result indices aligned with the input
+			dgr.statSummary.Streams++
+			dgr.curStreamOffset = 0
+
 			if substreamSize == 0 {
 				continue
 			}
-
-			dgr.statSummary.Streams++
-			dgr.curStreamOffset = 0
 		}
 
-		if dgr.cfg.MultipartStream && substreamSize == 0 {
-			// If we got here: cfg.ProcessNulInputs is true
-			// Special case for a one-time zero-CID emission
-			if err := dgr.streamAppend(nil); err != nil {
-				return nil, err
-			}
-		} else if err := dgr.processStream(substreamSize); err != nil {
+		if err := dgr.processStream(ctx, substreamSize); err != nil {
 			if err == io.ErrUnexpectedEOF {
 				return nil, fmt.Errorf(
 					"unexpected end of substream #%s after %s bytes (stream expected to be %s bytes long)",
@@ -157,41 +262,34 @@ func (dgr *Dagger) ProcessReader(inputReader io.Reader) (commp []byte, err error
 			}
 		}
 
-		if dgr.generateRoots || dgr.seenRoots != nil {
-
-			// cascading flush across the chain
-			var rootBlock *dgrblock.Header
-			for _, c := range dgr.chainedCollectors {
-				rootBlock = c.FlushState()
+		// cascading flush across the chain, leaving it ready for the next stream
+		var rootBlock *dgrblock.Header
+		for _, c := range dgr.chainedCollectors {
+			rootBlock = c.FlushState()
+			if ff, canFail := c.(flushFailer); canFail {
+				if err := ff.TakeFlushError(); err != nil {
+					return nil, err
+				}
 			}
+		}
 
-			if rootBlock != nil {
-
-				if dgr.seenRoots != nil {
-					dgr.mu.Lock()
-
-					var rootSeen bool
-					if sk := seenKey(rootBlock); sk != nil {
-						if _, rootSeen = dgr.seenRoots[*sk]; !rootSeen {
-							dgr.seenRoots[*sk] = seenRoot{
-								order: len(dgr.seenRoots),
-								cid:   rootBlock.Cid(),
-							}
-						}
-					}
-
-					dgr.statSummary.Roots = append(dgr.statSummary.Roots, rootStats{
-						Cid:         dgr.cidFormatter(rootBlock),
-						SizePayload: rootBlock.SizeCumulativePayload(),
-						SizeDag:     rootBlock.SizeCumulativeDag(),
-						Dup:         rootSeen,
-					})
-
-					dgr.mu.Unlock()
-				}
+		if rootBlock != nil {
+			res, err := newResult(rootBlock)
+			if err != nil {
+				return nil, err
+			}
+			res.Substream = dgr.statSummary.Streams
+			if _, isCommP := dgr.cfg.Collectors[0].(FilCommPCollector); isCommP {
+				res.PaddedPieceSize = res.DagSize
+			}
+			if tr, isTreeRetainer := dgr.chainedCollectors[0].(treeRetainer); isTreeRetainer {
+				res.PieceTree = tr.TakeTree()
 			}
+			results = append(results, res)
 
-			return rootBlock.Cid(), nil
+			if err := dgr.recordRoot(res); err != nil {
+				return nil, err
+			}
 		}
 
 		// we are in EOF-state: if we are not expecting multiparts - we are done
@@ -221,13 +319,17 @@ type chunkingInconsistencyHandler func(
 	errStr string,
 )
 
-func (dgr *Dagger) processStream(streamLimit int64) error {
+func (dgr *Dagger) processStream(ctx context.Context, streamLimit int64) error {
 
 	// begin reading and filling buffer
 	if err := dgr.qrb.StartFill(streamLimit); err != nil {
 		return err
 	}
 
+	// closed on return, releasing any chunking goroutines still in flight
+	abort := make(chan struct{})
+	defer close(abort)
+
 	var streamEndInView bool
 	var availableFromReader, processedFromReader int
 	var streamOffset int64
@@ -237,7 +339,7 @@ func (dgr *Dagger) processStream(streamLimit int64) error {
 	// this callback is passed through the recursive chain instead of a bare channel
 	// providing reasonable diag context
 	errHandler := func(chunkerIdx int, wrOffset int64, wrSize, wrPos int, errStr string) {
-		chunkingErr <- fmt.Errorf(`
+		err := fmt.Errorf(`
 
 chunking error
 --------------
@@ -265,12 +367,20 @@ chunking error: %s%s`,
 			errStr,
 			"\n\n",
 		)
+
+		select {
+		case chunkingErr <- err:
+		case <-abort:
+		}
 	}
 
 	for {
 
 		// next 2 lines evaluate processedInRound and availableForRound from *LAST* iteration
 		streamOffset += int64(processedFromReader)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		workRegion, readErr := dgr.qrb.NextRegion(availableFromReader - processedFromReader)
 
 		if workRegion == nil || (readErr != nil && readErr != io.EOF) {
@@ -294,6 +404,8 @@ chunking error: %s%s`,
 			0,
 			// the channel for the chunking results
 			rescursiveSplitResults,
+			// closed when nobody is listening on the above anymore
+			abort,
 			// func() instead of a channel, closes over the common error channel and several stream position vars
 			errHandler,
 		)
@@ -301,6 +413,8 @@ chunking error: %s%s`,
 	receiveChunks:
 		for {
 			select {
+			case <-ctx.Done():
+				return ctx.Err()
 			case err := <-chunkingErr:
 				return err
 			case res, chanOpen := <-rescursiveSplitResults:
@@ -312,6 +426,12 @@ chunking error: %s%s`,
 				if err != nil {
 					return err
 				}
+				if dgr.cfg.Progress != nil {
+					dgr.cfg.Progress(
+						dgr.statSummary.Dag.Payload+int64(processedFromReader),
+						dgr.curStreamOffset,
+					)
+				}
 			}
 		}
 
@@ -345,6 +465,7 @@ func (dgr *Dagger) recursivelySplitBuffer(
 	useEntireRegion bool,
 	chunkerIdx int,
 	recursiveResultsReturn chan<- *recursiveSplitResult,
+	abort <-chan struct{},
 	errHandler chunkingInconsistencyHandler,
 ) {
 	var processedBytes int
@@ -375,16 +496,25 @@ func (dgr *Dagger) recursivelySplitBuffer(
 					true, // subchunkers always "use entire region" by definition
 					chunkerIdx+1,
 					subSplits,
+					abort,
 					errHandler,
 				)
-				recursiveResultsReturn <- &recursiveSplitResult{subSplits: subSplits}
+				select {
+				case recursiveResultsReturn <- &recursiveSplitResult{subSplits: subSplits}:
+				case <-abort:
+					return errAborted
+				}
 			} else {
-				recursiveResultsReturn <- &recursiveSplitResult{
+				select {
+				case recursiveResultsReturn <- &recursiveSplitResult{
 					chunk: c,
 					chunkBufRegion: workRegion.SubRegion(
 						processedBytes,
 						c.Size,
 					),
+				}:
+				case <-abort:
+					return errAborted
 				}
 			}
 
@@ -404,6 +534,7 @@ func (dgr *Dagger) recursivelySplitBuffer(
 			useEntireRegion,
 			chunkerIdx+1,
 			recursiveResultsReturn,
+			abort,
 			errHandler,
 		)
 		return
@@ -0,0 +1,108 @@
+package dagger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/collector/filcommp"
+)
+
+// ErrReaderAtUnsupported is returned by ProcessReaderAt on instances not
+// configured with a sole fil-commP collector, or configured with
+// MultipartStream, RetainTree or PrePadded
+var ErrReaderAtUnsupported = errors.New("ProcessReaderAt requires a sole fil-commP collector without RetainTree or PrePadded, and no MultipartStream")
+
+// ProcessReaderAt computes the piece commitment of the first size bytes of
+// inputReader. Instead of hashing a single sequential stream, the payload is
+// split into power-of-two-aligned segments which are hashed concurrently by
+// AsyncHashersCount goroutines (at least one), and merged into the same
+// result ProcessReader would return for the same payload. The Progress hook
+// is invoked after every completed segment.
+func (dgr *Dagger) ProcessReaderAt(inputReader io.ReaderAt, size int64) (*Result, error) {
+	return dgr.ProcessReaderAtContext(context.Background(), inputReader, size)
+}
+
+// ProcessReaderAtContext is ProcessReaderAt with support for cancellation
+func (dgr *Dagger) ProcessReaderAtContext(ctx context.Context, inputReader io.ReaderAt, size int64) (res *Result, err error) {
+
+	if len(dgr.cfg.Collectors) != 1 || dgr.cfg.MultipartStream {
+		return nil, ErrReaderAtUnsupported
+	}
+	cpCfg, isCommP := dgr.cfg.Collectors[0].(FilCommPCollector)
+	if !isCommP || cpCfg.RetainTree || cpCfg.PrePadded {
+		return nil, ErrReaderAtUnsupported
+	}
+	pieceSize := filcommp.PaddedPieceSize(uint64(size))
+	if cpCfg.PaddedPieceSize != 0 {
+		if pieceSize > cpCfg.PaddedPieceSize {
+			return nil, fmt.Errorf(
+				"payload exceeds the %d bytes fitting the declared padded piece size of %d bytes",
+				cpCfg.PaddedPieceSize/128*127, cpCfg.PaddedPieceSize,
+			)
+		}
+		pieceSize = cpCfg.PaddedPieceSize
+	}
+
+	if err := dgr.claim(); err != nil {
+		return nil, err
+	}
+	defer dgr.release()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dgr.curStreamOffset = 0
+	dgr.statSummary.resetCounters()
+
+	if preProcessTasks != nil {
+		preProcessTasks(dgr)
+	}
+	t0 := time.Now()
+	defer func() {
+		if postProcessTasks != nil {
+			postProcessTasks(dgr)
+		}
+		dgr.statSummary.SysStats.ElapsedNsecs = time.Since(t0).Nanoseconds()
+	}()
+
+	var segmentDone func(int64)
+	if dgr.cfg.Progress != nil {
+		segmentDone = func(payloadBytes int64) {
+			dgr.statSummary.Dag.Payload += payloadBytes
+			dgr.cfg.Progress(dgr.statSummary.Dag.Payload, dgr.statSummary.Dag.Payload)
+		}
+	}
+
+	commP, err := filcommp.ReaderAtCommP(ctx, inputReader, size, dgr.cfg.AsyncHashersCount, segmentDone)
+	if err != nil {
+		return nil, err
+	}
+
+	commP = filcommp.PadCommP(commP, filcommp.PaddedPieceSize(uint64(size)), pieceSize)
+
+	c, err := cid.Cast(append([]byte(filcommp.CidPrefix), commP...))
+	if err != nil {
+		return nil, fmt.Errorf("undecodeable piece CID: %s", err)
+	}
+
+	dgr.statSummary.Streams = 1
+	dgr.statSummary.Dag.Payload = size
+	dgr.curStreamOffset = size
+
+	res = &Result{
+		Cid:             c,
+		PayloadSize:     uint64(size),
+		DagSize:         pieceSize,
+		PaddedPieceSize: pieceSize,
+	}
+	if err := dgr.recordRoot(res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,106 @@
+package dagger_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/ribasushi/fil-discover-check/dagger"
+)
+
+// testPayload returns size deterministic pseudo-random bytes
+func testPayload(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b) // nolint:errcheck
+	return b
+}
+
+func commPOptions(hashers int) dagger.Options {
+	opts := dagger.DefaultOptions()
+	opts.Collectors = []dagger.CollectorConfig{dagger.FilCommPCollector{}}
+	opts.AsyncHashersCount = hashers
+	return opts
+}
+
+func newDagger(tb testing.TB, opts dagger.Options) *dagger.Dagger {
+	dgr, err := dagger.New(opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(dgr.Destroy)
+	return dgr
+}
+
+func TestProcessReaderAtMatchesStream(t *testing.T) {
+
+	for _, size := range []int{127, 128, 127 * 1024, 127*1024 + 1, 1<<20 + 333, 5<<20 - 7} {
+		payload := testPayload(size)
+
+		stream, err := newDagger(t, commPOptions(0)).ProcessReader(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+
+		for _, hashers := range []int{0, 1, 3, 8} {
+			res, err := newDagger(t, commPOptions(hashers)).ProcessReaderAt(bytes.NewReader(payload), int64(size))
+			if err != nil {
+				t.Fatalf("%d bytes, %d hashers: %s", size, hashers, err)
+			}
+			if !res.Cid.Equals(stream[0].Cid) || res.PaddedPieceSize != stream[0].PaddedPieceSize || res.PayloadSize != stream[0].PayloadSize {
+				t.Errorf(
+					"%d bytes, %d hashers: ReaderAt result %s/%d differs from stream result %s/%d",
+					size, hashers, res.Cid, res.PaddedPieceSize, stream[0].Cid, stream[0].PaddedPieceSize,
+				)
+			}
+		}
+	}
+}
+
+func TestProcessReaderAtUnsupported(t *testing.T) {
+
+	for name, cp := range map[string]dagger.FilCommPCollector{
+		"RetainTree": {RetainTree: true},
+		"PrePadded":  {PrePadded: true},
+	} {
+		opts := commPOptions(1)
+		opts.Collectors = []dagger.CollectorConfig{cp}
+		if _, err := newDagger(t, opts).ProcessReaderAt(bytes.NewReader(testPayload(4096)), 4096); err != dagger.ErrReaderAtUnsupported {
+			t.Errorf("%s: expected ErrReaderAtUnsupported, got %v", name, err)
+		}
+	}
+}
+
+// Segments are hashed concurrently, so on a machine with enough cores the
+// throughput is expected to scale near-linearly with the amount of hashers.
+// Compare the MB/s column across the sub-benchmarks.
+func BenchmarkProcessReaderAt(b *testing.B) {
+
+	payload := testPayload(64 << 20)
+
+	for _, hashers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("hashers=%d", hashers), func(b *testing.B) {
+			dgr := newDagger(b, commPOptions(hashers))
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := dgr.ProcessReaderAt(bytes.NewReader(payload), int64(len(payload))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("stream", func(b *testing.B) {
+		dgr := newDagger(b, commPOptions(0))
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := dgr.ProcessReader(bytes.NewReader(payload)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
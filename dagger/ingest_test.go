@@ -0,0 +1,357 @@
+package dagger_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ribasushi/fil-discover-check/commp"
+	"github.com/ribasushi/fil-discover-check/dagger"
+)
+
+// naiveCommP builds the complete piece tree of payload one bit and one
+// layer at a time, independently of the optimized implementation
+func naiveCommP(payload []byte) []byte {
+
+	unpadded := 127
+	for unpadded < len(payload) {
+		unpadded *= 2
+	}
+	in := make([]byte, unpadded)
+	copy(in, payload)
+
+	// fr32: two zero bits after every 254 bits of payload
+	leaves := make([]byte, unpadded/127*128)
+	out := 0
+	for bit := 0; bit < len(in)*8; bit++ {
+		if out%256 == 254 {
+			out += 2
+		}
+		leaves[out/8] |= (in[bit/8] >> uint(bit%8) & 1) << uint(out%8)
+		out++
+	}
+
+	layer := make([][]byte, 0, len(leaves)/32)
+	for i := 0; i < len(leaves); i += 32 {
+		layer = append(layer, leaves[i:i+32])
+	}
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			node := sha256.Sum256(append(append([]byte{}, layer[2*i]...), layer[2*i+1]...))
+			node[31] &= 0x3F
+			layer[i] = node[:]
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer[0]
+}
+
+// sparsePayload is mostly zeroes, exercising the nul padding shortcuts
+func sparsePayload(size int) []byte {
+	b := make([]byte, size)
+	for i := size / 3; i < size/3+50 && i < size; i++ {
+		b[i] = 7
+	}
+	return b
+}
+
+func TestCommPMatchesNaiveReference(t *testing.T) {
+
+	// a single instance per configuration: every stream must start afresh
+	for _, hashers := range []int{0, 2} {
+		dgr := newDagger(t, commPOptions(hashers))
+
+		for _, size := range []int{127, 128, 254, 1000, 4064, 65536, 1 << 20, 3<<20 + 17} {
+			for _, payload := range [][]byte{testPayload(size), sparsePayload(size)} {
+
+				res, err := dgr.ProcessReader(bytes.NewReader(payload))
+				if err != nil {
+					t.Fatalf("%d bytes, %d hashers: %s", size, hashers, err)
+				}
+				if len(res) != 1 {
+					t.Fatalf("%d bytes, %d hashers: %d results", size, hashers, len(res))
+				}
+
+				want, err := commp.PieceCID(naiveCommP(payload))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !res[0].Cid.Equals(want) || res[0].PayloadSize != uint64(size) {
+					t.Errorf("%d bytes, %d hashers: got %s, expected %s", size, hashers, res[0].Cid, want)
+				}
+			}
+		}
+	}
+}
+
+var errRead = errors.New("read failed")
+
+// failingReader passes on the contents of r, then fails instead of reaching EOF
+type failingReader struct {
+	r io.Reader
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err == io.EOF {
+		err = errRead
+	}
+	return n, err
+}
+
+func TestReuseAfterFailure(t *testing.T) {
+
+	payload := testPayload(3<<20 + 5)
+	dgr := newDagger(t, commPOptions(2))
+
+	want, err := dgr.ProcessReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := dgr.ProcessReader(&failingReader{r: bytes.NewReader(testPayload(1<<20 + i))}); !errors.Is(err, errRead) {
+			t.Fatalf("expected the read failure, got %v", err)
+		}
+
+		// no state of the failed stream may leak into the next one
+		res, err := dgr.ProcessReader(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res[0].Cid.Equals(want[0].Cid) {
+			t.Fatalf("result after a failed stream %s differs from %s", res[0].Cid, want[0].Cid)
+		}
+	}
+}
+
+// blockingReader blocks the first read until released
+type blockingReader struct {
+	started, release chan struct{}
+}
+
+func (br *blockingReader) Read(p []byte) (int, error) {
+	if br.started != nil {
+		close(br.started)
+		br.started = nil
+		<-br.release
+	}
+	return 0, io.EOF
+}
+
+func TestOverlappingCallsRejected(t *testing.T) {
+
+	dgr := newDagger(t, commPOptions(0))
+	br := &blockingReader{started: make(chan struct{}), release: make(chan struct{})}
+	started := br.started
+
+	done := make(chan error)
+	go func() {
+		_, err := dgr.ProcessReader(br)
+		done <- err
+	}()
+	<-started
+
+	if _, err := dgr.ProcessReader(bytes.NewReader(testPayload(1000))); err == nil {
+		t.Error("overlapping ProcessReader() succeeded")
+	}
+
+	close(br.release)
+	<-done
+
+	if _, err := dgr.ProcessReader(bytes.NewReader(testPayload(1000))); err != nil {
+		t.Errorf("ProcessReader() after the overlap failed: %s", err)
+	}
+}
+
+// endlessReader produces data forever, cancelling its context once limit
+// bytes were read
+type endlessReader struct {
+	limit  int
+	read   int
+	cancel context.CancelFunc
+}
+
+func (er *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(er.read + i)
+	}
+	er.read += len(p)
+	if er.read >= er.limit {
+		er.cancel()
+	}
+	return len(p), nil
+}
+
+// cancellingReaderAt cancels its context on the first read past limit
+type cancellingReaderAt struct {
+	limit  int64
+	cancel context.CancelFunc
+}
+
+func (cr *cancellingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= cr.limit {
+		cr.cancel()
+	}
+	return len(p), nil
+}
+
+// settledGoroutines waits for the goroutine count to drop to want, returning
+// the last count observed
+func settledGoroutines(want int) int {
+	n := runtime.NumGoroutine()
+	for deadline := time.Now().Add(2 * time.Second); n > want && time.Now().Before(deadline); n = runtime.NumGoroutine() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return n
+}
+
+func TestCancellation(t *testing.T) {
+
+	before := runtime.NumGoroutine()
+
+	dgr, err := dagger.New(commPOptions(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dgr.ProcessReaderContext(ctx, &endlessReader{limit: 1}); err != context.Canceled {
+		t.Errorf("expected an immediate cancellation, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		er := &endlessReader{limit: (i + 1) << 20, cancel: cancel}
+		if _, err := dgr.ProcessReaderContext(ctx, er); err != context.Canceled {
+			t.Fatalf("expected cancellation, got %v", err)
+		}
+		if er.read > er.limit+64<<20 {
+			t.Errorf("reading continued for %d bytes past the cancellation", er.read-er.limit)
+		}
+
+		ctx, cancel = context.WithCancel(context.Background())
+		size := int64(64 << 20)
+		if _, err := dgr.ProcessReaderAtContext(ctx, &cancellingReaderAt{limit: size / 4, cancel: cancel}, size); err != context.Canceled {
+			t.Fatalf("expected cancellation of ProcessReaderAt, got %v", err)
+		}
+
+		// only the hashers of the instance remain
+		if n := settledGoroutines(idle); n > idle {
+			t.Fatalf("%d goroutines running after cancellation, %d expected", n, idle)
+		}
+	}
+
+	// the instance remains usable
+	res, err := dgr.ProcessReader(bytes.NewReader(sparsePayload(1 << 20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := commp.PieceCID(naiveCommP(sparsePayload(1 << 20)))
+	if !res[0].Cid.Equals(want) {
+		t.Errorf("result after cancellations %s differs from %s", res[0].Cid, want)
+	}
+
+	dgr.Destroy()
+	if n := settledGoroutines(before); n > before {
+		t.Errorf("%d goroutines running after Destroy(), %d expected", n, before)
+	}
+}
+
+// multipartInput frames payloads as MultipartStream substreams
+func multipartInput(payloads ...[]byte) []byte {
+	var input []byte
+	for _, p := range payloads {
+		input = append(input, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(input[len(input)-8:], uint64(len(p)))
+		input = append(input, p...)
+	}
+	return input
+}
+
+func TestMultipartSubstreams(t *testing.T) {
+
+	payloads := [][]byte{testPayload(1000), nil, testPayload(3<<20 + 5), nil, sparsePayload(127), nil}
+	input := multipartInput(payloads...)
+
+	opts := commPOptions(2)
+	opts.MultipartStream = true
+	dgr := newDagger(t, opts)
+
+	res, err := dgr.ProcessReader(bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// empty substreams produce no result, but are counted
+	var expected []int64
+	for i, p := range payloads {
+		if len(p) > 0 {
+			expected = append(expected, int64(i+1))
+		}
+	}
+	if len(res) != len(expected) {
+		t.Fatalf("%d results for %d non-empty substreams", len(res), len(expected))
+	}
+	for i, r := range res {
+		p := payloads[r.Substream-1]
+		want, _ := commp.PieceCID(naiveCommP(p))
+		if r.Substream != expected[i] || !r.Cid.Equals(want) || r.PayloadSize != uint64(len(p)) {
+			t.Errorf("result #%d: substream %d %s/%d, expected substream %d %s/%d", i, r.Substream, r.Cid, r.PayloadSize, expected[i], want, len(p))
+		}
+	}
+
+	// a substream cut short of its announced size
+	if _, err := dgr.ProcessReader(bytes.NewReader(input[:len(input)-30])); err == nil {
+		t.Error("truncated substream accepted")
+	}
+}
+
+func TestProgress(t *testing.T) {
+
+	var reported []int64
+	opts := commPOptions(2)
+	opts.Progress = func(processedBytes, streamOffset int64) {
+		reported = append(reported, processedBytes)
+	}
+	dgr := newDagger(t, opts)
+
+	payload := testPayload(5<<20 + 7)
+	for name, process := range map[string]func() error{
+		"ProcessReader": func() error {
+			_, err := dgr.ProcessReader(bytes.NewReader(payload))
+			return err
+		},
+		"ProcessReaderAt": func() error {
+			_, err := dgr.ProcessReaderAt(bytes.NewReader(payload), int64(len(payload)))
+			return err
+		},
+	} {
+		// twice: every call reports from the start of its own payload
+		for pass := 0; pass < 2; pass++ {
+			reported = reported[:0]
+			if err := process(); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if len(reported) < 2 {
+				t.Fatalf("%s: progress reported %d times", name, len(reported))
+			}
+			for i := 1; i < len(reported); i++ {
+				if reported[i] <= reported[i-1] {
+					t.Fatalf("%s: progress went from %d to %d", name, reported[i-1], reported[i])
+				}
+			}
+			if last := reported[len(reported)-1]; last != int64(len(payload)) {
+				t.Errorf("%s: last progress of %d bytes, expected %d", name, last, len(payload))
+			}
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package dagger
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/cpuid"
+
+	"github.com/ribasushi/fil-discover-check/internal/constants"
+	dgrchunker "github.com/ribasushi/fil-discover-check/internal/dagger/chunker"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/chunker/fixedsize"
+	dgrcollector "github.com/ribasushi/fil-discover-check/internal/dagger/collector"
+	"github.com/ribasushi/fil-discover-check/internal/dagger/collector/filcommp"
+	"github.com/ribasushi/fil-discover-check/internal/util/text"
+)
+
+// ChunkerConfig is implemented by the typed configuration of every available
+// chunker, e.g. FixedSizeChunker
+type ChunkerConfig = dgrchunker.Config
+
+// CollectorConfig is implemented by the typed configuration of every
+// available collector, e.g. FilCommPCollector
+type CollectorConfig = dgrcollector.Config
+
+// FixedSizeChunker splits the stream into equally sized chunks
+type FixedSizeChunker = fixedsize.Config
+
+// FilCommPCollector calculates the Filecoin piece commitment of the stream.
+// When it is the sole collector an empty chunker chain is permitted, and is
+// populated with the chunker configuration commP requires, as returned by
+// RequiredChunkSize().
+type FilCommPCollector = filcommp.Config
+
+// Names of the available emitters, used as keys of Options.Emitters
+const (
+	EmitterStatsText  = "stats-text"
+	EmitterStatsJsonl = "stats-jsonl"
+	EmitterRootsJsonl = "roots-jsonl"
+)
+
+// Bits of Options.StatsActive
+const (
+	GatherStatsBlocks = 1 << iota
+	GatherStatsRingbuf
+)
+
+// ProgressFunc receives the amount of payload processed so far by the current
+// ProcessReader call, and the offset reached within the current (sub)stream.
+// It is invoked synchronously from the goroutine calling ProcessReader and
+// must return promptly.
+type ProgressFunc func(processedBytes, streamOffset int64)
+
+// Options is the complete typed configuration of a Dagger. Start from
+// DefaultOptions(): the zero value of several fields is meaningful.
+type Options struct {
+	// Stream chunking algorithm chain, applied in order
+	Chunkers []ChunkerConfig
+	// Node-forming algorithm chain, applied in order
+	Collectors []CollectorConfig
+
+	// Expect multiple SInt64BE-size-prefixed streams on the input
+	MultipartStream bool
+
+	// Number of concurrent goroutines performing hashing. Set to 0 (disable)
+	// for predictable benchmarking: all hashing then takes place synchronously
+	// in the goroutine calling ProcessReader.
+	AsyncHashersCount int
+
+	// The size of the quantized ring buffer used for ingestion
+	RingBufferSize int
+	// (EXPERT SETTING) The size of each buffer synchronization sector
+	RingBufferSectSize int
+	// (EXPERT SETTING) Perform next read(2) only when the specified amount of
+	// free space is available in the buffer
+	RingBufferMinRead int
+
+	// A bitfield of GatherStats* flags
+	StatsActive uint
+
+	// Optional callback invoked after every top-level chunk is processed
+	Progress ProgressFunc
+
+	// Destinations of the active emitters, keyed by Emitter* names. A
+	// missing or nil entry leaves the emitter inactive.
+	Emitters map[string]io.Writer
+}
+
+// DefaultOptions returns the defaults used by the CLI, with empty chunker and
+// collector chains and no active emitters
+func DefaultOptions() Options {
+	return Options{
+		// Some minimal non-controversial defaults, all overridable
+		// Try really hard to *NOT* have defaults that influence resulting CIDs
+		AsyncHashersCount: tinygoWorkaroundNumCPU(), // SANCHECK yes, this is high: seems the simd version knows what to do...
+
+		StatsActive: 0 | GatherStatsBlocks,
+
+		// RingBufferSize: 2*constants.MaxLeafPayloadSize + 256*1024, // bare-minimum with defaults
+		RingBufferSize: 24 * 1024 * 1024, // SANCHECK low seems good somehow... fits in L3 maybe?
+
+		//SANCHECK: these numbers have not been validated
+		RingBufferMinRead:  256 * 1024,
+		RingBufferSectSize: 64 * 1024,
+	}
+}
+
+// OptionsError lists every problem found with the supplied Options
+type OptionsError struct {
+	Problems []string
+
+	// names of the plugins which failed to initialize
+	erroredChunkers   []string
+	erroredCollectors []string
+}
+
+func (e *OptionsError) Error() string {
+	return "invalid dagger options:\n\t" + strings.Join(e.Problems, "\n\t")
+}
+
+// New returns a Dagger configured with the supplied options
+func New(opts Options) (*Dagger, error) {
+
+	dgr := &Dagger{
+		cfg:               opts,
+		shutdownSemaphore: make(chan struct{}),
+	}
+
+	// do not share the emitter map with the caller
+	dgr.cfg.Emitters = make(map[string]io.Writer, len(opts.Emitters))
+	for k, v := range opts.Emitters {
+		dgr.cfg.Emitters[k] = v
+	}
+
+	// init some constants
+	{
+		s := &dgr.statSummary
+		s.EventType = "summary"
+
+		s.SysStats.PageSize = tinygoWorkaroundGetpagesize()
+		s.SysStats.Os = runtime.GOOS
+		s.SysStats.GoMaxProcs = runtime.GOMAXPROCS(-1)
+		s.SysStats.GoNumCPU = tinygoWorkaroundNumCPU()
+		s.SysStats.GoVersion = tinygoWorkaroundGoVersion()
+		s.SysStats.CPU.NameStr = cpuid.CPU.BrandName
+		s.SysStats.CPU.Cores = cpuid.CPU.PhysicalCores
+		s.SysStats.CPU.ThreadsPerCore = cpuid.CPU.ThreadsPerCore
+		s.SysStats.CPU.FreqMHz = int(cpuid.CPU.Hz / 1000000)
+		s.SysStats.CPU.Vendor = cpuid.CPU.VendorString
+		s.SysStats.CPU.Family = cpuid.CPU.Family
+		s.SysStats.CPU.Model = cpuid.CPU.Model
+
+		feats := cpuid.CPU.Features.Strings()
+		sort.Strings(feats)
+		s.SysStats.CPU.FeaturesStr = strings.Join(feats, " ")
+	}
+
+	oErr := new(OptionsError)
+
+	// commP is very special
+	if len(dgr.cfg.Collectors) == 1 {
+		if cpCfg, isCommP := dgr.cfg.Collectors[0].(FilCommPCollector); isCommP {
+			requiredChunker := FixedSizeChunker{Size: cpCfg.RequiredChunkSize()}
+			if len(dgr.cfg.Chunkers) == 0 {
+				dgr.cfg.Chunkers = []ChunkerConfig{requiredChunker}
+			}
+			if len(dgr.cfg.Chunkers) != 1 || dgr.cfg.Chunkers[0] != ChunkerConfig(requiredChunker) {
+				oErr.Problems = append(oErr.Problems, fmt.Sprintf(
+					"fil-commP requires a sole fixed-size chunker of %d bytes",
+					cpCfg.RequiredChunkSize(),
+				))
+			}
+		}
+	}
+
+	dgr.setupChunkerChain(oErr)
+	dgr.setupCollectorChain(oErr)
+	dgr.setupEmitters(oErr)
+
+	if len(oErr.Problems) > 0 {
+		sort.Strings(oErr.Problems)
+		return nil, oErr
+	}
+
+	return dgr, nil
+}
+
+func (dgr *Dagger) setupEmitters(oErr *OptionsError) {
+
+	for name := range dgr.cfg.Emitters {
+		switch name {
+		case EmitterStatsText, EmitterStatsJsonl, EmitterRootsJsonl:
+		default:
+			oErr.Problems = append(oErr.Problems, fmt.Sprintf(
+				"invalid emitter '%s'. Available emitters are: %s",
+				name,
+				text.AvailableMapKeys(map[string]struct{}{
+					EmitterStatsText:  {},
+					EmitterStatsJsonl: {},
+					EmitterRootsJsonl: {},
+				}),
+			))
+		}
+	}
+
+	// set couple shortcuts based on emitter config
+	dgr.generateRoots = (dgr.cfg.Emitters[EmitterRootsJsonl] != nil || dgr.cfg.Emitters[EmitterStatsJsonl] != nil)
+
+	// duplicate roots are flagged whenever roots are reported, against every
+	// root seen over the lifetime of the instance
+	if dgr.generateRoots {
+		dgr.seenRoots = make(seenRoots)
+	}
+}
+
+func (dgr *Dagger) setupChunkerChain(oErr *OptionsError) {
+
+	// bail early
+	if len(dgr.cfg.Chunkers) == 0 {
+		oErr.Problems = append(oErr.Problems, "at least one stream chunker must be specified")
+		return
+	}
+
+	for chunkerNum, chunkerCfg := range dgr.cfg.Chunkers {
+
+		chunkerInstance, chunkerConstants, initErrors := chunkerCfg.NewInstance(
+			&dgrchunker.DaggerConfig{
+				IsLastInChain: (chunkerNum == len(dgr.cfg.Chunkers)-1),
+			},
+		)
+
+		if len(initErrors) == 0 {
+			if chunkerConstants.MaxChunkSize < 1 || chunkerConstants.MaxChunkSize > constants.MaxLeafPayloadSize {
+				initErrors = append(initErrors, fmt.Sprintf(
+					"returned MaxChunkSize constant '%d' out of range [1:%d]",
+					chunkerConstants.MaxChunkSize,
+					constants.MaxLeafPayloadSize,
+				))
+			} else if chunkerConstants.MinChunkSize < 0 || chunkerConstants.MinChunkSize > chunkerConstants.MaxChunkSize {
+				initErrors = append(initErrors, fmt.Sprintf(
+					"returned MinChunkSize constant '%d' out of range [0:%d]",
+					chunkerConstants.MinChunkSize,
+					chunkerConstants.MaxChunkSize,
+				))
+			}
+		}
+
+		if len(initErrors) > 0 {
+			oErr.erroredChunkers = append(oErr.erroredChunkers, chunkerCfg.Name())
+			for _, e := range initErrors {
+				oErr.Problems = append(oErr.Problems, fmt.Sprintf(
+					"Initialization of chunker '%s' failed: %s",
+					chunkerCfg.Name(),
+					e,
+				))
+			}
+		} else {
+			dgr.chainedChunkers = append(dgr.chainedChunkers, dgrChunkerUnit{
+				instance:  chunkerInstance,
+				constants: chunkerConstants,
+			})
+		}
+	}
+}
+
+func (dgr *Dagger) setupCollectorChain(oErr *OptionsError) {
+
+	// bail early
+	if len(dgr.cfg.Collectors) == 0 {
+		oErr.Problems = append(oErr.Problems, "at least one collector must be specified")
+		return
+	}
+
+	commonCfg := dgrcollector.DaggerConfig{
+		AsyncHashersCount: dgr.cfg.AsyncHashersCount,
+		ShutdownSemaphore: dgr.shutdownSemaphore,
+		ShutdownWaitGroup: &dgr.shutdownWG,
+	}
+
+	for _, c := range dgr.chainedChunkers {
+		if c.constants.MaxChunkSize > commonCfg.ChunkerChainMaxResult {
+			commonCfg.ChunkerChainMaxResult = c.constants.MaxChunkSize
+		}
+	}
+
+	// we need to process the collectors in reverse, in order to populate NextCollector
+	dgr.chainedCollectors = make([]dgrcollector.Collector, len(dgr.cfg.Collectors))
+	for collectorNum := len(dgr.cfg.Collectors); collectorNum > 0; collectorNum-- {
+
+		collectorCfg := dgr.cfg.Collectors[collectorNum-1]
+
+		dgrCfg := commonCfg // SHALLOW COPY!!!
+		dgrCfg.ChainPosition = collectorNum
+		if collectorNum != len(dgr.cfg.Collectors) {
+			dgrCfg.NextCollector = dgr.chainedCollectors[collectorNum]
+		}
+
+		if collectorInstance, initErrors := collectorCfg.NewInstance(&dgrCfg); len(initErrors) > 0 {
+
+			oErr.erroredCollectors = append(oErr.erroredCollectors, collectorCfg.Name())
+			for _, e := range initErrors {
+				oErr.Problems = append(oErr.Problems, fmt.Sprintf(
+					"Initialization of collector '%s' failed: %s",
+					collectorCfg.Name(),
+					e,
+				))
+			}
+		} else {
+			dgr.chainedCollectors[collectorNum-1] = collectorInstance
+		}
+	}
+}
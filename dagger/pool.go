@@ -0,0 +1,121 @@
+package dagger
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Pool maintains a set of identically configured Dagger instances, allowing
+// concurrent callers to process independent streams without paying for the
+// setup and ring buffer allocation of a new instance on every stream.
+//
+// Instances are retained until Destroy(): a sync.Pool is not suitable, as it
+// would silently drop instances together with their background goroutines.
+// Note that instances sharing an emitter destination will interleave their
+// output.
+type Pool struct {
+	opts      Options
+	mu        sync.Mutex
+	idle      []*Dagger
+	destroyed bool
+}
+
+// NewPool validates opts by constructing the first instance of the pool
+func NewPool(opts Options) (*Pool, error) {
+	dgr, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pool{
+		opts: opts,
+		idle: []*Dagger{dgr},
+	}, nil
+}
+
+// Get returns an idle instance, or a new one if none are available. The
+// caller has exclusive use of the instance until it is handed back via Put().
+func (p *Pool) Get() (*Dagger, error) {
+	p.mu.Lock()
+
+	if p.destroyed {
+		p.mu.Unlock()
+		return nil, errors.New("use of a destroyed Pool")
+	}
+
+	if n := len(p.idle); n > 0 {
+		dgr := p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return dgr, nil
+	}
+
+	p.mu.Unlock()
+	return New(p.opts)
+}
+
+// Put returns an instance obtained from Get() back to the pool
+func (p *Pool) Put(dgr *Dagger) {
+	p.mu.Lock()
+	if !p.destroyed {
+		p.idle = append(p.idle, dgr)
+		dgr = nil
+	}
+	p.mu.Unlock()
+
+	// the pool was destroyed while the instance was in use
+	if dgr != nil {
+		dgr.Destroy()
+	}
+}
+
+// ProcessReader is a shortcut for Get(), Dagger.ProcessReader() and Put()
+func (p *Pool) ProcessReader(inputReader io.Reader) ([]*Result, error) {
+	return p.ProcessReaderContext(context.Background(), inputReader)
+}
+
+// ProcessReaderContext is a shortcut for Get(), Dagger.ProcessReaderContext()
+// and Put()
+func (p *Pool) ProcessReaderContext(ctx context.Context, inputReader io.Reader) ([]*Result, error) {
+	dgr, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(dgr)
+
+	return dgr.ProcessReaderContext(ctx, inputReader)
+}
+
+// ProcessReaderAt is a shortcut for Get(), Dagger.ProcessReaderAt() and Put()
+func (p *Pool) ProcessReaderAt(inputReader io.ReaderAt, size int64) (*Result, error) {
+	return p.ProcessReaderAtContext(context.Background(), inputReader, size)
+}
+
+// ProcessReaderAtContext is a shortcut for Get(),
+// Dagger.ProcessReaderAtContext() and Put()
+func (p *Pool) ProcessReaderAtContext(ctx context.Context, inputReader io.ReaderAt, size int64) (*Result, error) {
+	dgr, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(dgr)
+
+	return dgr.ProcessReaderAtContext(ctx, inputReader, size)
+}
+
+// Destroy destroys all idle instances. Instances currently in use are
+// destroyed as they are returned via Put().
+func (p *Pool) Destroy() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.destroyed = true
+	p.mu.Unlock()
+
+	for _, dgr := range idle {
+		dgr.Destroy()
+	}
+}
@@ -0,0 +1,143 @@
+package dagger_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/ribasushi/fil-discover-check/dagger"
+)
+
+func TestPoolConcurrentStreams(t *testing.T) {
+
+	pool, err := dagger.NewPool(commPOptions(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+
+	payloads := [][]byte{testPayload(1<<20 + 1), sparsePayload(2 << 20)}
+	want := make([]*dagger.Result, len(payloads))
+	for i, p := range payloads {
+		res, err := newDagger(t, commPOptions(0)).ProcessReader(bytes.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = res[0]
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 4; i++ {
+				idx := (g + i) % len(payloads)
+				res, err := pool.ProcessReader(bytes.NewReader(payloads[idx]))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !res[0].Cid.Equals(want[idx].Cid) {
+					t.Errorf("pooled result %s differs from %s", res[0].Cid, want[idx].Cid)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestPoolReusesInstances(t *testing.T) {
+
+	pool, err := dagger.NewPool(commPOptions(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("Get() handed out the same instance twice")
+	}
+
+	pool.Put(first)
+	if again, _ := pool.Get(); again != first {
+		t.Error("Get() did not reuse the idle instance")
+	}
+	pool.Put(first)
+
+	pool.Destroy()
+	if _, err := pool.Get(); err == nil {
+		t.Error("Get() on a destroyed pool succeeded")
+	}
+
+	// returned after Destroy(): destroyed on the spot
+	pool.Put(second)
+	if _, err := second.ProcessReader(bytes.NewReader(testPayload(1000))); err == nil {
+		t.Error("instance returned to a destroyed pool remains usable")
+	}
+}
+
+// The fresh variant is what every caller had to do before instances became
+// reusable: compare the allocations per stream across the sub-benchmarks.
+func BenchmarkStreams(b *testing.B) {
+
+	payload := testPayload(1 << 20)
+
+	b.Run("fresh", func(b *testing.B) {
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dgr, err := dagger.New(commPOptions(1))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := dgr.ProcessReader(bytes.NewReader(payload)); err != nil {
+				b.Fatal(err)
+			}
+			dgr.Destroy()
+		}
+	})
+
+	b.Run("reused", func(b *testing.B) {
+		dgr := newDagger(b, commPOptions(1))
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := dgr.ProcessReader(bytes.NewReader(payload)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("pool", func(b *testing.B) {
+		pool, err := dagger.NewPool(commPOptions(1))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer pool.Destroy()
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := pool.ProcessReader(bytes.NewReader(payload)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
@@ -2,10 +2,8 @@ package dagger
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/ipfs/go-qringbuf"
-	dgrblock "github.com/ribasushi/fil-discover-check/internal/dagger/block"
 
 	"github.com/ribasushi/fil-discover-check/internal/constants"
 	"github.com/ribasushi/fil-discover-check/internal/util/text"
@@ -28,12 +26,11 @@ type seenRoot struct {
 
 type seenRoots map[[seenHashSize]byte]seenRoot
 
-func seenKey(b *dgrblock.Header) (id *[seenHashSize]byte) {
-	if b == nil {
+func seenKey(cid []byte) (id *[seenHashSize]byte) {
+	if len(cid) < seenHashSize {
 		return
 	}
 
-	cid := b.Cid()
 	id = new([seenHashSize]byte)
 	copy(
 		id[:],
@@ -88,30 +85,103 @@ type statSummary struct {
 		GoVersion    string   `json:"goVersion"`
 	} `json:"sys"`
 }
+
+// resetCounters zeroes everything gathered while processing a stream, keeping
+// the static system description
+func (smr *statSummary) resetCounters() {
+	prev := smr.SysStats
+
+	*smr = statSummary{EventType: smr.EventType}
+
+	sys := &smr.SysStats
+	sys.PageSize = prev.PageSize
+	sys.CPU = prev.CPU
+	sys.GoMaxProcs = prev.GoMaxProcs
+	sys.GoNumCPU = prev.GoNumCPU
+	sys.Os = prev.Os
+	sys.ArgvExpanded = prev.ArgvExpanded
+	sys.ArgvInitial = prev.ArgvInitial
+	sys.GoVersion = prev.GoVersion
+}
+
 type rootStats struct {
+	Substream   int64  `json:"substream,omitempty"`
 	Cid         string `json:"cid"`
 	SizeDag     uint64 `json:"wireSize"`
 	SizePayload uint64 `json:"payload"`
 	Dup         bool   `json:"duplicate,omitempty"`
 }
 
-func (dgr *Dagger) OutputSummary() {
+func (dgr *Dagger) recordRoot(res *Result) error {
+
+	if !dgr.generateRoots {
+		return nil
+	}
+
+	var rootSeen bool
+	if dgr.seenRoots != nil {
+		dgr.mu.Lock()
+		if sk := seenKey(res.Cid.Bytes()); sk != nil {
+			if _, rootSeen = dgr.seenRoots[*sk]; !rootSeen {
+				dgr.seenRoots[*sk] = seenRoot{
+					order: len(dgr.seenRoots),
+					cid:   res.Cid.Bytes(),
+				}
+			}
+		}
+		dgr.mu.Unlock()
+	}
+
+	rs := rootStats{
+		Substream:   res.Substream,
+		Cid:         res.Cid.String(),
+		SizePayload: res.PayloadSize,
+		SizeDag:     res.DagSize,
+		Dup:         rootSeen,
+	}
+	dgr.statSummary.Roots = append(dgr.statSummary.Roots, rs)
+
+	if rootsOut := dgr.cfg.Emitters[EmitterRootsJsonl]; rootsOut != nil {
+		return rs.writeAsJSON(rootsOut)
+	}
+	return nil
+}
+
+// EmissionError is returned when writing to the destination of an emitter fails
+type EmissionError struct {
+	Emitter string
+	Err     error
+}
+
+func (e *EmissionError) Error() string {
+	return fmt.Sprintf("emitting '%s' failed: %s", e.Emitter, e.Err)
+}
+func (e *EmissionError) Unwrap() error { return e.Err }
+
+// OutputSummary writes the statistics of the last processed stream to the
+// stats-text and stats-jsonl emitters, if any are active. A failed write is
+// returned as an *EmissionError.
+func (dgr *Dagger) OutputSummary() (err error) {
 
 	// no stats emitters - nowhere to output
-	if dgr.cfg.emitters[emStatsText] == nil && dgr.cfg.emitters[emStatsJsonl] == nil {
-		return
+	if dgr.cfg.Emitters[EmitterStatsText] == nil && dgr.cfg.Emitters[EmitterStatsJsonl] == nil {
+		return nil
 	}
 
 	smr := &dgr.statSummary
 
-	if statsJsonlOut := dgr.cfg.emitters[emStatsJsonl]; statsJsonlOut != nil {
+	if statsJsonlOut := dgr.cfg.Emitters[EmitterStatsJsonl]; statsJsonlOut != nil {
 		// emit the JSON last, so that piping to e.g. `jq` works nicer
-		defer smr.writeAsJSON(statsJsonlOut)
+		defer func() {
+			if err == nil {
+				err = smr.writeAsJSON(statsJsonlOut)
+			}
+		}()
 	}
 
-	statsTextOut := dgr.cfg.emitters[emStatsText]
+	statsTextOut := dgr.cfg.Emitters[EmitterStatsText]
 	if statsTextOut == nil {
-		return
+		return nil
 	}
 
 	var substreamsDesc string
@@ -123,8 +193,11 @@ func (dgr *Dagger) OutputSummary() {
 	}
 
 	writeTextOutf := func(f string, args ...interface{}) {
-		if _, err := fmt.Fprintf(statsTextOut, f, args...); err != nil {
-			log.Fatalf("Emitting '%s' failed: %s", emStatsText, err)
+		if err != nil {
+			return
+		}
+		if _, wErr := fmt.Fprintf(statsTextOut, f, args...); wErr != nil {
+			err = &EmissionError{Emitter: EmitterStatsText, Err: wErr}
 		}
 	}
 
@@ -167,4 +240,18 @@ func (dgr *Dagger) OutputSummary() {
 		)
 	}
 
+	var dupRoots int
+	for _, rs := range smr.Roots {
+		if rs.Dup {
+			dupRoots++
+		}
+	}
+	if dupRoots > 0 {
+		writeTextOutf(
+			"Previously seen roots:%16s out of %s\n",
+			text.Commify(dupRoots), text.Commify(len(smr.Roots)),
+		)
+	}
+
+	return
 }
@@ -0,0 +1,66 @@
+package dagger_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/ribasushi/fil-discover-check/dagger"
+)
+
+type rootLine struct {
+	Substream int64  `json:"substream"`
+	Cid       string `json:"cid"`
+	WireSize  uint64 `json:"wireSize"`
+	Payload   uint64 `json:"payload"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+func decodeRoots(t *testing.T, out *bytes.Buffer) []rootLine {
+	var lines []rootLine
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		var l rootLine
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			t.Fatalf("undecodeable line %q: %s", sc.Text(), err)
+		}
+		lines = append(lines, l)
+	}
+	out.Reset()
+	return lines
+}
+
+func TestRootsJsonl(t *testing.T) {
+
+	var out bytes.Buffer
+	opts := commPOptions(0)
+	opts.Emitters = map[string]io.Writer{dagger.EmitterRootsJsonl: &out}
+	dgr := newDagger(t, opts)
+
+	payload := testPayload(1000)
+	for i, dup := range []bool{false, true} {
+		res, err := dgr.ProcessReader(bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := rootLine{Cid: res[0].Cid.String(), WireSize: 1024, Payload: 1000, Duplicate: dup}
+		if lines := decodeRoots(t, &out); len(lines) != 1 || lines[0] != want {
+			t.Errorf("pass #%d: emitted %+v, expected %+v", i, lines, want)
+		}
+	}
+
+	opts.MultipartStream = true
+	res, err := newDagger(t, opts).ProcessReader(bytes.NewReader(multipartInput(testPayload(2000), nil, payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []rootLine{
+		{Substream: 1, Cid: res[0].Cid.String(), WireSize: 2048, Payload: 2000},
+		{Substream: 3, Cid: res[1].Cid.String(), WireSize: 1024, Payload: 1000},
+	}
+	if lines := decodeRoots(t, &out); len(lines) != 2 || lines[0] != want[0] || lines[1] != want[1] {
+		t.Errorf("multipart: emitted %+v, expected %+v", lines, want)
+	}
+}
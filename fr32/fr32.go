@@ -0,0 +1,61 @@
+// Package fr32 implements the bit-padding Filecoin applies to piece payloads
+// before committing to them: every 254 bits of payload are followed by 2 zero
+// bits, so that each 32 byte leaf of the resulting piece is a valid element of
+// the BLS12-381 scalar field. Thus every 127 bytes of payload expand into 128.
+package fr32
+
+import "fmt"
+
+// Sizes of a quantum: the smallest amount of payload expanding into a whole
+// number of bytes, and the size of its expansion
+const (
+	UnpaddedQuantum = 127
+	PaddedQuantum   = 128
+)
+
+// PaddedSize returns the size of the expansion of payloadSize bytes, with the
+// last partial quantum, if any, zero-filled
+func PaddedSize(payloadSize uint64) uint64 {
+	return (payloadSize + UnpaddedQuantum - 1) / UnpaddedQuantum * PaddedQuantum
+}
+
+// Pad returns the fr32 expansion of payload. A trailing partial quantum is
+// padded as if it was followed by zeroes, matching the way commP is computed.
+func Pad(payload []byte) []byte {
+
+	out := make([]byte, PaddedSize(uint64(len(payload))))
+
+	full := len(payload) / UnpaddedQuantum
+	for q := 0; q < full; q++ {
+		PadQuantum(out[q*PaddedQuantum:], payload[q*UnpaddedQuantum:])
+	}
+
+	if rem := len(payload) % UnpaddedQuantum; rem != 0 {
+		last := make([]byte, UnpaddedQuantum)
+		copy(last, payload[full*UnpaddedQuantum:])
+		PadQuantum(out[full*PaddedQuantum:], last)
+	}
+
+	return out
+}
+
+// Unpad returns the payload of an fr32 expansion, which must consist of whole
+// quanta. The padding of a trailing partial payload quantum comes back as
+// zeroes: callers knowing the original payload size should truncate to it.
+// The shims are discarded without validation.
+func Unpad(padded []byte) ([]byte, error) {
+
+	if len(padded)%PaddedQuantum != 0 {
+		return nil, fmt.Errorf(
+			"padded data of %d bytes is not a multiple of the %d byte quantum",
+			len(padded), PaddedQuantum,
+		)
+	}
+
+	out := make([]byte, len(padded)/PaddedQuantum*UnpaddedQuantum)
+	for q := 0; q < len(padded)/PaddedQuantum; q++ {
+		UnpadQuantum(out[q*UnpaddedQuantum:], padded[q*PaddedQuantum:])
+	}
+
+	return out, nil
+}
@@ -0,0 +1,187 @@
+package fr32_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/ribasushi/fil-discover-check/fr32"
+)
+
+var testSizes = []int{0, 1, 126, 127, 128, 254, 1000, 127 << 10, 127<<10 + 5, 1 << 20}
+
+func testPayload(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b) // nolint:errcheck
+	return b
+}
+
+// naivePad inserts the shims one bit at a time
+func naivePad(payload []byte) []byte {
+	in := make([]byte, (len(payload)+126)/127*127)
+	copy(in, payload)
+
+	out := make([]byte, len(in)/127*128)
+	pos := 0
+	for bit := 0; bit < len(in)*8; bit++ {
+		if pos%256 == 254 {
+			pos += 2
+		}
+		out[pos/8] |= (in[bit/8] >> uint(bit%8) & 1) << uint(pos%8)
+		pos++
+	}
+	return out
+}
+
+func TestPadRoundTrip(t *testing.T) {
+
+	for _, size := range testSizes {
+		payload := testPayload(size)
+
+		padded := fr32.Pad(payload)
+		if uint64(len(padded)) != fr32.PaddedSize(uint64(size)) {
+			t.Fatalf("%d bytes: padded to %d bytes instead of %d", size, len(padded), fr32.PaddedSize(uint64(size)))
+		}
+		if !bytes.Equal(padded, naivePad(payload)) {
+			t.Fatalf("%d bytes: padding differs from the reference", size)
+		}
+
+		unpadded, err := fr32.Unpad(padded)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if !bytes.Equal(unpadded[:size], payload) {
+			t.Errorf("%d bytes: round trip mismatch", size)
+		}
+		// the zero-filled remainder of a partial trailing quantum
+		if !bytes.Equal(unpadded[size:], make([]byte, len(unpadded)-size)) {
+			t.Errorf("%d bytes: non-zero tail past the payload", size)
+		}
+	}
+}
+
+func TestUnpadPartialQuantum(t *testing.T) {
+	for _, size := range []int{1, 127, 129, 255} {
+		if _, err := fr32.Unpad(make([]byte, size)); err == nil {
+			t.Errorf("unpadding %d bytes succeeded", size)
+		}
+	}
+}
+
+// chunkyReader returns random amounts of data from every read
+type chunkyReader struct {
+	r   io.Reader
+	rng *rand.Rand
+}
+
+func (cr chunkyReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1+cr.rng.Intn(len(p))]
+	}
+	return cr.r.Read(p)
+}
+
+// writeChunky writes data in random amounts
+func writeChunky(t *testing.T, w io.Writer, data []byte, rng *rand.Rand) {
+	for len(data) > 0 {
+		n := 1 + rng.Intn(len(data))
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+}
+
+func TestStreamTransformers(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+
+	for _, size := range testSizes {
+		payload := testPayload(size)
+		padded := fr32.Pad(payload)
+		unpadded, _ := fr32.Unpad(padded)
+
+		got, err := ioutil.ReadAll(fr32.NewPadReader(chunkyReader{bytes.NewReader(payload), rng}))
+		if err != nil || !bytes.Equal(got, padded) {
+			t.Errorf("%d bytes: pad reader mismatch (%v)", size, err)
+		}
+
+		got, err = ioutil.ReadAll(fr32.NewUnpadReader(chunkyReader{bytes.NewReader(padded), rng}))
+		if err != nil || !bytes.Equal(got, unpadded) {
+			t.Errorf("%d bytes: unpad reader mismatch (%v)", size, err)
+		}
+
+		var buf bytes.Buffer
+		w := fr32.NewPadWriter(&buf)
+		writeChunky(t, w, payload, rng)
+		if err := w.Close(); err != nil || !bytes.Equal(buf.Bytes(), padded) {
+			t.Errorf("%d bytes: pad writer mismatch (%v)", size, err)
+		}
+		if _, err := w.Write([]byte{1}); err == nil {
+			t.Errorf("%d bytes: write after close succeeded", size)
+		}
+
+		buf.Reset()
+		w = fr32.NewUnpadWriter(&buf)
+		writeChunky(t, w, padded, rng)
+		if err := w.Close(); err != nil || !bytes.Equal(buf.Bytes(), unpadded) {
+			t.Errorf("%d bytes: unpad writer mismatch (%v)", size, err)
+		}
+	}
+}
+
+func TestStreamPartialQuantum(t *testing.T) {
+
+	rng := rand.New(rand.NewSource(1))
+	padded := append(fr32.Pad(testPayload(127<<10)), 1, 2, 3)
+
+	got, err := ioutil.ReadAll(fr32.NewUnpadReader(chunkyReader{bytes.NewReader(padded), rng}))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF from the unpad reader, got %v", err)
+	}
+	if len(got) != 127<<10 {
+		t.Errorf("expected the %d bytes of whole quanta before the failure, got %d", 127<<10, len(got))
+	}
+
+	w := fr32.NewUnpadWriter(ioutil.Discard)
+	writeChunky(t, w, padded, rng)
+	if err := w.Close(); err == nil {
+		t.Error("closing the unpad writer with a partial quantum pending succeeded")
+	}
+}
+
+func BenchmarkPad(b *testing.B) {
+	payload := testPayload(127 << 13)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fr32.Pad(payload)
+	}
+}
+
+func BenchmarkPadReader(b *testing.B) {
+	payload := testPayload(127 << 13)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.Copy(ioutil.Discard, fr32.NewPadReader(bytes.NewReader(payload))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnpad(b *testing.B) {
+	padded := fr32.Pad(testPayload(127 << 13))
+	b.SetBytes(int64(len(padded)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fr32.Unpad(padded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package fr32
+
+// PadQuantum expands UnpaddedQuantum bytes of payload from window into the
+// PaddedQuantum bytes of four fr32 leaves in expansion, by inserting a 2-bit
+// zero "shim" after every 254 bits
+func PadQuantum(expansion, window []byte) {
+
+	window = window[:UnpaddedQuantum:UnpaddedQuantum]
+	expansion = expansion[:PaddedQuantum:PaddedQuantum]
+
+	// Cycle over four(4) 31-byte groups, leaving 1 byte in between:
+	// 31 + 1 + 31 + 1 + 31 + 1 + 31 = 127
+
+	// First 31 bytes + 6 bits are taken as-is (trimmed later)
+	// Note that copying them into the expansion buffer is not strictly
+	// necessary: one could feed the range to the hasher directly. However
+	// there are significant optimizations to be had when feeding exactly 64
+	// bytes at a time to the sha256 implementation, thus keeping the copy()
+	copy(expansion, window[:32])
+
+	// first 2-bit "shim" forced into the otherwise identical bitstream
+	expansion[31] &= 0x3F
+
+	// simplify pointer math
+	windowPlus1, expansionPlus1 := window[1:], expansion[1:]
+
+	//  In: {{ C[7] C[6] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
+	// Out:                 X[5] X[4] X[3] X[2] X[1] X[0] C[7] C[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] X[7] X[6] Z[5] Z[4] Z[3]...
+	for i := 31; i < 63; i++ {
+		expansionPlus1[i] = windowPlus1[i]<<2 | window[i]>>6
+	}
+
+	// next 2-bit shim
+	expansion[63] &= 0x3F
+
+	//  In: {{ C[7] C[6] C[5] C[4] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
+	// Out:                           X[3] X[2] X[1] X[0] C[7] C[6] C[5] C[4] Y[3] Y[2] Y[1] Y[0] X[7] X[6] X[5] X[4] Z[3] Z[2] Z[1]...
+	for i := 63; i < 95; i++ {
+		expansionPlus1[i] = windowPlus1[i]<<4 | window[i]>>4
+	}
+
+	// next 2-bit shim
+	expansion[95] &= 0x3F
+
+	//  In: {{ C[7] C[6] C[5] C[4] C[3] C[2] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
+	// Out:                                     X[1] X[0] C[7] C[6] C[5] C[4] C[3] C[2] Y[1] Y[0] X[7] X[6] X[5] X[4] X[3] X[2] Z[1] Z[0] Y[7]...
+	for i := 95; i < 126; i++ {
+		expansionPlus1[i] = windowPlus1[i]<<6 | window[i]>>2
+	}
+	// the final 6 bit remainder is exactly the value of the last expanded byte
+	expansion[127] = window[126] >> 2
+}
+
+// UnpadQuantum is the inverse of PadQuantum: it collapses the PaddedQuantum
+// bytes of four fr32 leaves in expansion back into UnpaddedQuantum bytes of
+// payload in window, discarding the shims
+func UnpadQuantum(window, expansion []byte) {
+
+	window = window[:UnpaddedQuantum:UnpaddedQuantum]
+	expansion = expansion[:PaddedQuantum:PaddedQuantum]
+
+	copy(window, expansion[:31])
+	window[31] = expansion[31]&0x3F | expansion[32]<<6
+
+	for i := 32; i < 63; i++ {
+		window[i] = expansion[i]>>2 | expansion[i+1]<<6
+	}
+	window[63] = (expansion[63]&0x3F)>>2 | expansion[64]<<4
+
+	for i := 64; i < 95; i++ {
+		window[i] = expansion[i]>>4 | expansion[i+1]<<4
+	}
+	window[95] = (expansion[95]&0x3F)>>4 | expansion[96]<<2
+
+	for i := 96; i < 127; i++ {
+		window[i] = expansion[i]>>6 | expansion[i+1]<<2
+	}
+}
@@ -0,0 +1,187 @@
+package fr32
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// amount of quanta transformed in one go by the stream transformers
+const streamQuanta = 1 << 10
+
+// transform describes one direction of the fr32 conversion
+type transform struct {
+	inSize, outSize int
+	quantum         func(out, in []byte)
+	// whether a trailing partial input quantum is zero-filled (padding) or
+	// is an error (unpadding)
+	zeroFillTail bool
+}
+
+var padding = transform{UnpaddedQuantum, PaddedQuantum, PadQuantum, true}
+var unpadding = transform{PaddedQuantum, UnpaddedQuantum, UnpadQuantum, false}
+
+func (t *transform) run(out, in []byte) []byte {
+	out = out[:0]
+	for q := 0; q*t.inSize < len(in); q++ {
+		out = out[:(q+1)*t.outSize]
+		t.quantum(out[q*t.outSize:], in[q*t.inSize:])
+	}
+	return out
+}
+
+func (t *transform) tailErr(tail int) error {
+	return fmt.Errorf(
+		"trailing %d bytes do not form a complete %d byte quantum",
+		tail, t.inSize,
+	)
+}
+
+type reader struct {
+	transform
+	r       io.Reader
+	in      []byte
+	have    int // amount of input carried over from the previous read
+	out     []byte
+	pending []byte // transformed data not yet returned
+	err     error
+}
+
+// NewPadReader returns a reader of the fr32 expansion of the data read from
+// r. A trailing partial quantum is padded as if it was followed by zeroes.
+func NewPadReader(r io.Reader) io.Reader { return newReader(padding, r) }
+
+// NewUnpadReader returns a reader of the payload of the fr32 expansion read
+// from r. A trailing partial quantum results in io.ErrUnexpectedEOF.
+func NewUnpadReader(r io.Reader) io.Reader { return newReader(unpadding, r) }
+
+func newReader(t transform, r io.Reader) *reader {
+	return &reader{
+		transform: t,
+		r:         r,
+		in:        make([]byte, streamQuanta*t.inSize),
+		out:       make([]byte, streamQuanta*t.outSize),
+	}
+}
+
+func (tr *reader) Read(p []byte) (int, error) {
+
+	for len(tr.pending) == 0 {
+		if tr.err != nil {
+			return 0, tr.err
+		}
+		tr.fill()
+	}
+
+	n := copy(p, tr.pending)
+	tr.pending = tr.pending[n:]
+	return n, nil
+}
+
+func (tr *reader) fill() {
+
+	n, err := io.ReadFull(tr.r, tr.in[tr.have:])
+	tr.have += n
+
+	whole := tr.have / tr.inSize * tr.inSize
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = io.EOF
+		if tail := tr.have - whole; tail > 0 {
+			if tr.zeroFillTail {
+				for i := tr.have; i < whole+tr.inSize; i++ {
+					tr.in[i] = 0
+				}
+				whole += tr.inSize
+			} else {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+	}
+	tr.err = err
+
+	tr.pending = tr.run(tr.out, tr.in[:whole])
+	if whole < tr.have {
+		tr.have = copy(tr.in, tr.in[whole:tr.have])
+	} else {
+		tr.have = 0
+	}
+}
+
+type writer struct {
+	transform
+	w      io.Writer
+	in     []byte
+	have   int
+	out    []byte
+	closed bool
+}
+
+// NewPadWriter returns a writer passing the fr32 expansion of everything
+// written to it on to w. Close() pads a trailing partial quantum as if it was
+// followed by zeroes and flushes it. It does not close w.
+func NewPadWriter(w io.Writer) io.WriteCloser { return newWriter(padding, w) }
+
+// NewUnpadWriter returns a writer passing the payload of the fr32 expansion
+// written to it on to w. Close() fails if a partial quantum remains. It does
+// not close w.
+func NewUnpadWriter(w io.Writer) io.WriteCloser { return newWriter(unpadding, w) }
+
+func newWriter(t transform, w io.Writer) *writer {
+	return &writer{
+		transform: t,
+		w:         w,
+		in:        make([]byte, streamQuanta*t.inSize),
+		out:       make([]byte, streamQuanta*t.outSize),
+	}
+}
+
+var errWriterClosed = errors.New("write to a closed fr32 writer")
+
+func (tw *writer) Write(p []byte) (written int, err error) {
+
+	if tw.closed {
+		return 0, errWriterClosed
+	}
+
+	for len(p) > 0 {
+		n := copy(tw.in[tw.have:], p)
+		tw.have += n
+		p = p[n:]
+
+		if tw.have == len(tw.in) {
+			if err := tw.flush(len(tw.in)); err != nil {
+				return written, err
+			}
+		}
+		written += n
+	}
+
+	return written, nil
+}
+
+func (tw *writer) flush(size int) error {
+	_, err := tw.w.Write(tw.run(tw.out, tw.in[:size]))
+	tw.have = 0
+	return err
+}
+
+func (tw *writer) Close() error {
+
+	if tw.closed {
+		return nil
+	}
+	tw.closed = true
+
+	whole := tw.have / tw.inSize * tw.inSize
+	if tail := tw.have - whole; tail > 0 {
+		if !tw.zeroFillTail {
+			return tw.tailErr(tail)
+		}
+		for i := tw.have; i < whole+tw.inSize; i++ {
+			tw.in[i] = 0
+		}
+		whole += tw.inSize
+	}
+
+	return tw.flush(whole)
+}
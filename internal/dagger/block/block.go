@@ -44,11 +44,6 @@ type DataSource struct {
 	Content       *zcpstring.ZcpString
 }
 
-type hashTask struct {
-	postTruncateCidTo int
-	hdr               *Header
-}
-
 // Makes code easier to follow - in most conditionals in maker below
 // the CID is "ready" instantly/synchronously. It is only in the very
 // last case that we spawn an actual goroutine: then we make a *new* channel
@@ -15,11 +15,22 @@ type DaggerConfig struct {
 	IsLastInChain bool
 }
 
-type Initializer func(
+// Config is implemented by the typed configuration of every available chunker
+type Config interface {
+	Name() string
+	NewInstance(cfg *DaggerConfig) (
+		instance chunker.Chunker,
+		constants InstanceConstants,
+		initErrorStrings []string,
+	)
+}
+
+// ArgParser turns the CLI sub-arguments of a chunker into its typed Config.
+// On nil args the "errors" are the help text to be incorporated into the
+// larger help display.
+type ArgParser func(
 	chunkerCLISubArgs []string,
-	cfg *DaggerConfig,
 ) (
-	instance chunker.Chunker,
-	constants InstanceConstants,
+	cfg Config,
 	initErrorStrings []string,
 )
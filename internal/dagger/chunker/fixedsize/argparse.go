@@ -4,22 +4,12 @@ import (
 	"fmt"
 	"strconv"
 
-	"github.com/ribasushi/fil-discover-check/chunker"
-	"github.com/ribasushi/fil-discover-check/internal/constants"
 	dgrchunker "github.com/ribasushi/fil-discover-check/internal/dagger/chunker"
 
 	"github.com/ribasushi/fil-discover-check/internal/dagger/util/argparser"
-	"github.com/ribasushi/fil-discover-check/internal/util/text"
 )
 
-func NewChunker(
-	args []string,
-	dgrCfg *dgrchunker.DaggerConfig,
-) (
-	_ chunker.Chunker,
-	_ dgrchunker.InstanceConstants,
-	initErrs []string,
-) {
+func ParseArgs(args []string) (_ dgrchunker.Config, initErrs []string) {
 
 	// on nil-args the "error" is the help text to be incorporated into
 	// the larger help display
@@ -32,7 +22,7 @@ func NewChunker(
 		return
 	}
 
-	c := fixedSizeChunker{}
+	var cfg Config
 
 	if len(args) != 2 {
 		initErrs = append(initErrs, "chunker requires an integer argument, the size of each chunk in bytes")
@@ -45,20 +35,9 @@ func NewChunker(
 		if err != nil {
 			initErrs = append(initErrs, fmt.Sprintf("argument parse failed: %s", err))
 		} else {
-			c.size = int(sizearg)
+			cfg.Size = int(sizearg)
 		}
 	}
 
-	if c.size > constants.MaxLeafPayloadSize {
-		initErrs = append(initErrs, fmt.Sprintf(
-			"provided chunk size '%s' exceeds specified maximum payload size '%s",
-			text.Commify(c.size),
-			text.Commify(constants.MaxLeafPayloadSize),
-		))
-	}
-
-	return &c, dgrchunker.InstanceConstants{
-		MinChunkSize: c.size,
-		MaxChunkSize: c.size,
-	}, initErrs
+	return cfg, initErrs
 }
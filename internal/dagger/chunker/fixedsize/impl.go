@@ -1,9 +1,50 @@
 package fixedsize
 
 import (
+	"fmt"
+
 	"github.com/ribasushi/fil-discover-check/chunker"
+	"github.com/ribasushi/fil-discover-check/internal/constants"
+	dgrchunker "github.com/ribasushi/fil-discover-check/internal/dagger/chunker"
+	"github.com/ribasushi/fil-discover-check/internal/util/text"
 )
 
+// Config of the fixed-size chunker
+type Config struct {
+	// Size of each chunk in bytes (IPFS default: 262144)
+	Size int
+}
+
+func (Config) Name() string { return "fixed-size" }
+
+func (cfg Config) NewInstance(
+	dgrCfg *dgrchunker.DaggerConfig,
+) (
+	_ chunker.Chunker,
+	_ dgrchunker.InstanceConstants,
+	initErrs []string,
+) {
+
+	if cfg.Size < 1 {
+		initErrs = append(initErrs, "chunk size must be a positive integer")
+	} else if cfg.Size > constants.MaxLeafPayloadSize {
+		initErrs = append(initErrs, fmt.Sprintf(
+			"provided chunk size '%s' exceeds specified maximum payload size '%s",
+			text.Commify(cfg.Size),
+			text.Commify(constants.MaxLeafPayloadSize),
+		))
+	}
+
+	if len(initErrs) > 0 {
+		return
+	}
+
+	return &fixedSizeChunker{size: cfg.Size}, dgrchunker.InstanceConstants{
+		MinChunkSize: cfg.Size,
+		MaxChunkSize: cfg.Size,
+	}, nil
+}
+
 type fixedSizeChunker struct {
 	size int
 }
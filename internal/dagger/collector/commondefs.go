@@ -1,6 +1,8 @@
 package dgrcollector
 
 import (
+	"sync"
+
 	dgrblock "github.com/ribasushi/fil-discover-check/internal/dagger/block"
 )
 
@@ -8,6 +10,7 @@ type Collector interface {
 	AppendData(formLeafBlockAndAppend dgrblock.DataSource) (resultingLeafBlock *dgrblock.Header, err error)
 	AppendBlock(blockToAppendToStream *dgrblock.Header) error
 	FlushState() (rootBlockAfterReducingAndDestroyingObjectState *dgrblock.Header)
+	Reset() // discard any accumulated state, e.g. after a stream error
 }
 
 type DaggerConfig struct {
@@ -17,11 +20,26 @@ type DaggerConfig struct {
 	// for collectors doing their own hashing
 	AsyncHashersCount int
 	ShutdownSemaphore <-chan struct{}
+	ShutdownWaitGroup *sync.WaitGroup // tracks every goroutine terminating on ShutdownSemaphore
 
 	NextCollector Collector
 }
 
-type Initializer func(
+// Config is implemented by the typed configuration of every available collector
+type Config interface {
+	Name() string
+	NewInstance(cfg *DaggerConfig) (
+		instance Collector,
+		initErrorStrings []string,
+	)
+}
+
+// ArgParser turns the CLI sub-arguments of a collector into its typed Config.
+// On nil args the "errors" are the help text to be incorporated into the
+// larger help display.
+type ArgParser func(
 	collectorCLISubArgs []string,
-	cfg *DaggerConfig,
-) (instance Collector, initErrorStrings []string)
+) (
+	cfg Config,
+	initErrorStrings []string,
+)
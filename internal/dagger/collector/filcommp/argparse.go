@@ -1,59 +1,49 @@
 package filcommp
 
 import (
-	sha256simd "github.com/minio/sha256-simd"
+	"github.com/pborman/getopt/v2"
 	dgrcollector "github.com/ribasushi/fil-discover-check/internal/dagger/collector"
 	"github.com/ribasushi/fil-discover-check/internal/dagger/util/argparser"
 )
 
-func NewCollector(args []string, dgrCfg *dgrcollector.DaggerConfig) (_ dgrcollector.Collector, initErrs []string) {
+func ParseArgs(args []string) (_ dgrcollector.Config, initErrs []string) {
+
+	optSet := getopt.New()
+	retainLevel := optSet.IntLong(
+		"retain-tree", 0, 0,
+		"Retain the commitment tree of every stream from the given level up: 0 retains the 32 byte leaves, every level up halves the memory required",
+		"level",
+	)
+	prePadded := optSet.BoolLong(
+		"pre-padded", 0,
+		"The stream is already fr32-padded, as stored in unsealed sectors: hash its 128 byte quanta directly, rejecting invalid padding",
+	)
+	pieceSize := optSet.Uint64Long(
+		"padded-piece-size", 0, 0,
+		"Calculate the commitment of a zero-padded piece of the given power-of-two size instead of the smallest one fitting the stream, e.g. as declared by a deal",
+		"bytes",
+	)
 
 	if args == nil {
 		initErrs = argparser.SubHelp(
-			"None\n",
-			nil,
+			"Calculates the Filecoin piece commitment of the stream\n",
+			optSet,
 		)
 		return
 	}
 
-	if len(args) > 1 {
-		initErrs = append(initErrs, "collector takes no arguments")
-	}
-	if dgrCfg.NextCollector != nil || dgrCfg.ChainPosition != 1 {
-		initErrs = append(initErrs, "collector must be used standalone, can not be mixed with others")
-	}
-
-	if len(initErrs) > 0 {
+	if initErrs = argparser.Parse(args, optSet); len(initErrs) > 0 {
 		return
 	}
 
-	// Initialize collector
-	cp := &commpCollector{
-		fr32WorkBuf:       make([]byte, StrideSize),
-		stackedNulPadding: make([][]byte, maxLayers),
-		globalShutdown:    dgrCfg.ShutdownSemaphore,
+	cfg := Config{
+		PaddedPieceSize: *pieceSize,
+		PrePadded:       *prePadded,
 	}
-
-	// initialize the nul padding stack (cheap to do upfront)
-	h := sha256simd.New()
-	for i := range cp.stackedNulPadding {
-
-		if i == 0 {
-			cp.stackedNulPadding[0] = make([]byte, 32)
-		} else {
-			h.Reset()
-
-			// yes, twice
-			h.Write(cp.stackedNulPadding[i-1])
-			h.Write(cp.stackedNulPadding[i-1])
-
-			cp.stackedNulPadding[i] = h.Sum(make([]byte, 0, 32))
-			cp.stackedNulPadding[i][31] &= 0x3F
-		}
+	if optSet.IsSet("retain-tree") {
+		cfg.RetainTree = true
+		cfg.TreeBaseLevel = *retainLevel
 	}
 
-	// Initialize state
-	cp.reset()
-
-	return cp, initErrs
+	return cfg, initErrs
 }
@@ -0,0 +1,108 @@
+package filcommp
+
+import (
+	"fmt"
+	"hash"
+)
+
+// Calc is a streaming commP calculator implementing hash.Hash, for payloads
+// already flowing through a pipeline of their own. The zero value is ready
+// for use. Calc is not safe for concurrent use.
+type Calc struct {
+	nh          *nodeHasher
+	stack       nodeStack
+	quantBuf    [127]byte
+	quantLen    int // amount of quantBuf filled by previous writes
+	payloadSize uint64
+	node        [32]byte // scratch space of appendQuantum()
+}
+
+var _ hash.Hash = (*Calc)(nil)
+
+// Size returns the size of the commP digest
+func (c *Calc) Size() int { return 32 }
+
+// BlockSize returns the size of an fr32 quantum: writes in multiples of it
+// avoid internal buffering
+func (c *Calc) BlockSize() int { return 127 }
+
+// Reset discards all written data
+func (c *Calc) Reset() {
+	c.payloadSize = 0
+	c.quantLen = 0
+	c.stack = nodeStack{}
+}
+
+// Write adds data to the payload. It never fails, unless the total would
+// exceed MaxPiecePayload, in which case nothing is written.
+func (c *Calc) Write(p []byte) (int, error) {
+
+	if c.payloadSize+uint64(len(p)) > MaxPiecePayload {
+		return 0, fmt.Errorf("maximum proving tree payload size of %d bytes exceeded", MaxPiecePayload)
+	}
+
+	if c.nh == nil {
+		c.nh = newNodeHasher()
+	}
+	c.payloadSize += uint64(len(p))
+	written := len(p)
+
+	// complete a quantum left over from a previous write
+	if c.quantLen > 0 {
+		n := copy(c.quantBuf[c.quantLen:], p)
+		c.quantLen += n
+		p = p[n:]
+		if c.quantLen < 127 {
+			return written, nil
+		}
+		c.appendQuantum(c.quantBuf[:])
+		c.quantLen = 0
+	}
+
+	for len(p) >= 127 {
+		c.appendQuantum(p[:127])
+		p = p[127:]
+	}
+	c.quantLen = copy(c.quantBuf[:], p)
+
+	return written, nil
+}
+
+func (c *Calc) appendQuantum(window []byte) {
+	c.nh.quantumNode(c.node[:], window, nil, nil)
+	c.stack.push(c.nh, c.node[:], 2)
+}
+
+// Digest returns the commP of the data written so far and the size of the
+// piece it commits to, without altering the state of the calculator
+func (c *Calc) Digest() (commP []byte, paddedPieceSize uint64, err error) {
+
+	if err := checkMinPayload(c.payloadSize); err != nil {
+		return nil, 0, err
+	}
+	paddedPieceSize = PaddedPieceSize(c.payloadSize)
+
+	// work on a copy of the pending nodes, the state remains writable
+	tmp := c.stack
+
+	if c.quantLen > 0 {
+		var lastQuantum [127]byte
+		copy(lastQuantum[:], c.quantBuf[:c.quantLen])
+		var n2 [32]byte
+		c.nh.quantumNode(n2[:], lastQuantum[:], nil, nil)
+		tmp.push(c.nh, n2[:], 2)
+	}
+
+	return append([]byte{}, tmp.complete(c.nh, rootLevel(paddedPieceSize))...), paddedPieceSize, nil
+}
+
+// Sum appends the commP of the data written so far to b, as required by
+// hash.Hash. As hash.Hash leaves no room for an error, Sum panics when less
+// than 127 bytes were written: use Digest() to receive an error instead.
+func (c *Calc) Sum(b []byte) []byte {
+	commP, _, err := c.Digest()
+	if err != nil {
+		panic(err)
+	}
+	return append(b, commP...)
+}
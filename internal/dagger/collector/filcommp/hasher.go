@@ -0,0 +1,255 @@
+package filcommp
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+
+	sha256simd "github.com/minio/sha256-simd"
+	"github.com/ribasushi/fil-discover-check/fr32"
+)
+
+// SANCHECK: job sizes picked to amortize the channel round-trip, not measured
+const (
+	leafJobQuanta = 512
+	pairJobPairs  = 2048
+)
+
+var errShutdown = errors.New("commP hashing aborted by shutdown")
+
+// a payload quantum of zeroes expands into 4 zero leaves, thus into nul padding
+var zeroQuantum = make([]byte, 128)
+
+// nodeHasher carries the reusable state of a single hashing goroutine
+type nodeHasher struct {
+	h         hash.Hash
+	expansion []byte
+	level1    []byte
+}
+
+func newNodeHasher() *nodeHasher {
+	return &nodeHasher{
+		h:         sha256simd.New(),
+		expansion: make([]byte, 128),
+		level1:    make([]byte, 64),
+	}
+}
+
+func (nh *nodeHasher) hash254Into(out, left, right []byte) {
+	nh.h.Reset()
+	nh.h.Write(left)
+	nh.h.Write(right)
+	nh.h.Sum(out[:0])
+	out[31] &= 0x3F
+}
+
+// parentInto places the parent of two nodes of the given level into out. The
+// parent of two all-zero subtrees is the precomputed nul padding one level
+// up, and is not hashed again: long zero runs cost a couple of comparisons.
+func (nh *nodeHasher) parentInto(out, left, right []byte, level int) {
+	if level+1 < len(stackedNulPadding) &&
+		bytes.Equal(left, stackedNulPadding[level]) &&
+		bytes.Equal(right, stackedNulPadding[level]) {
+		copy(out, stackedNulPadding[level+1])
+		return
+	}
+	nh.hash254Into(out, left, right)
+}
+
+// quantumNode fr32-expands 127 bytes of payload and hashes the resulting four
+// leaves into their level 2 node. The leaves and the two level 1 nodes are
+// additionally copied out when non-nil leaves/level1 are supplied.
+func (nh *nodeHasher) quantumNode(out, window, leaves, level1 []byte) {
+	if bytes.Equal(window, zeroQuantum[:127]) {
+		nh.expandedNode(out, zeroQuantum, leaves, level1)
+		return
+	}
+	fr32.PadQuantum(nh.expansion, window)
+	nh.expandedNode(out, nh.expansion, leaves, level1)
+}
+
+// expandedNode is quantumNode for 128 bytes of already fr32-expanded leaves
+func (nh *nodeHasher) expandedNode(out, expansion, leaves, level1 []byte) {
+
+	if leaves != nil {
+		copy(leaves, expansion)
+	}
+
+	if bytes.Equal(expansion, zeroQuantum) {
+		if level1 != nil {
+			copy(level1, stackedNulPadding[1])
+			copy(level1[32:], stackedNulPadding[1])
+		}
+		copy(out, stackedNulPadding[2])
+		return
+	}
+
+	nh.hash254Into(nh.level1[:32], expansion[:32], expansion[32:64])
+	nh.hash254Into(nh.level1[32:], expansion[64:96], expansion[96:128])
+	if level1 != nil {
+		copy(level1, nh.level1)
+	}
+	nh.hash254Into(out, nh.level1[:32], nh.level1[32:])
+}
+
+// hashJob is a unit of work of the hashing pool: either a run of payload
+// quanta hashed into level 2 nodes, or a run of node pairs hashed into their
+// parents
+type hashJob struct {
+	// quanta job
+	payload   []byte
+	prePadded bool   // payload consists of 128 byte expanded quanta
+	leavesOut []byte // optional
+	level1Out []byte // optional
+	level2Out []byte
+
+	// pairs job
+	pairs      []byte
+	pairsLevel int
+	parentsOut []byte
+
+	doneSignal chan<- struct{}
+}
+
+func (j *hashJob) run(nh *nodeHasher) {
+	if j.payload != nil {
+		quantSize := 127
+		if j.prePadded {
+			quantSize = 128
+		}
+		for q := 0; q*quantSize < len(j.payload); q++ {
+			var leaves, level1 []byte
+			if j.leavesOut != nil {
+				leaves = j.leavesOut[q*128 : q*128+128]
+			}
+			if j.level1Out != nil {
+				level1 = j.level1Out[q*64 : q*64+64]
+			}
+			if j.prePadded {
+				nh.expandedNode(j.level2Out[q*32:q*32+32], j.payload[q*128:q*128+128], leaves, level1)
+			} else {
+				nh.quantumNode(j.level2Out[q*32:q*32+32], j.payload[q*127:q*127+127], leaves, level1)
+			}
+		}
+	} else {
+		for p := 0; p*64 < len(j.pairs); p++ {
+			nh.parentInto(j.parentsOut[p*32:p*32+32], j.pairs[p*64:p*64+32], j.pairs[p*64+32:p*64+64], j.pairsLevel)
+		}
+	}
+}
+
+// startHashers launches the bounded pool of hashing goroutines, shared by the
+// leaf and upper layers, terminating on the global shutdown
+func (cp *commpCollector) startHashers(count int) {
+	cp.jobQueue = make(chan *hashJob)
+	for i := 0; i < count; i++ {
+		cp.globalShutdownWG.Add(1)
+		go func() {
+			defer cp.globalShutdownWG.Done()
+			nh := newNodeHasher()
+			for {
+				select {
+				case <-cp.globalShutdown:
+					return
+				case j := <-cp.jobQueue:
+					j.run(nh)
+					j.doneSignal <- struct{}{}
+				}
+			}
+		}()
+	}
+}
+
+// runJobs executes the jobs and waits for their completion. Without a pool
+// the jobs are executed synchronously, in order, by the calling goroutine.
+func (cp *commpCollector) runJobs(jobs []*hashJob) error {
+
+	if cp.jobQueue == nil {
+		for _, j := range jobs {
+			j.run(cp.inlineHasher)
+		}
+		return nil
+	}
+
+	done := make(chan struct{}, len(jobs))
+	for _, j := range jobs {
+		j.doneSignal = done
+		select {
+		case cp.jobQueue <- j:
+		case <-cp.globalShutdown:
+			return errShutdown
+		}
+	}
+	for range jobs {
+		select {
+		case <-done:
+		case <-cp.globalShutdown:
+			return errShutdown
+		}
+	}
+	return nil
+}
+
+// hashQuanta hashes the 127 byte quanta of payload (or 128 byte quanta of
+// PrePadded input) into level 2 nodes, optionally returning the leaves and
+// level 1 nodes as well
+func (cp *commpCollector) hashQuanta(payload []byte, withLeaves, withLevel1 bool) (leaves, level1, level2 []byte, err error) {
+
+	quantSize := 127
+	if cp.prePadded {
+		quantSize = 128
+	}
+	quanta := len(payload) / quantSize
+	level2 = make([]byte, quanta*32)
+	if withLeaves {
+		leaves = make([]byte, quanta*128)
+	}
+	if withLevel1 {
+		level1 = make([]byte, quanta*64)
+	}
+
+	jobs := make([]*hashJob, 0, (quanta+leafJobQuanta-1)/leafJobQuanta)
+	for start := 0; start < quanta; start += leafJobQuanta {
+		end := start + leafJobQuanta
+		if end > quanta {
+			end = quanta
+		}
+		j := &hashJob{
+			payload:   payload[start*quantSize : end*quantSize],
+			prePadded: cp.prePadded,
+			level2Out: level2[start*32 : end*32],
+		}
+		if withLeaves {
+			j.leavesOut = leaves[start*128 : end*128]
+		}
+		if withLevel1 {
+			j.level1Out = level1[start*64 : end*64]
+		}
+		jobs = append(jobs, j)
+	}
+
+	err = cp.runJobs(jobs)
+	return
+}
+
+// hashPairs hashes the concatenated pairs of nodes of a level into their parents
+func (cp *commpCollector) hashPairs(pairs []byte, level int) ([]byte, error) {
+
+	count := len(pairs) / 64
+	parents := make([]byte, count*32)
+
+	jobs := make([]*hashJob, 0, (count+pairJobPairs-1)/pairJobPairs)
+	for start := 0; start < count; start += pairJobPairs {
+		end := start + pairJobPairs
+		if end > count {
+			end = count
+		}
+		jobs = append(jobs, &hashJob{
+			pairs:      pairs[start*64 : end*64],
+			pairsLevel: level,
+			parentsOut: parents[start*32 : end*32],
+		})
+	}
+
+	return parents, cp.runJobs(jobs)
+}
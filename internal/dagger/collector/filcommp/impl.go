@@ -3,35 +3,204 @@ package filcommp
 import (
 	"errors"
 	"fmt"
-	"math"
+	"math/bits"
 	"sync"
 
 	sha256simd "github.com/minio/sha256-simd"
 	"github.com/ribasushi/fil-discover-check/internal/constants"
 	dgrblock "github.com/ribasushi/fil-discover-check/internal/dagger/block"
+	dgrcollector "github.com/ribasushi/fil-discover-check/internal/dagger/collector"
 )
 
 const maxLayers = 31 // == log2( 64 GiB / 32 )
 
 const StrideSize = constants.MaxLeafPayloadSize - (constants.MaxLeafPayloadSize % 127)
+
+// PaddedStrideSize is the chunk size used with PrePadded input
+const PaddedStrideSize = constants.MaxLeafPayloadSize - (constants.MaxLeafPayloadSize % 128)
 const MaxPiecePayload = uint64(127 * (((1 << maxLayers) * 32) / 128))
 
+// CidPrefix is prepended to the 32 byte commP digest to form a piece CID:
+// CIDv1, fil-commitment-unsealed codec (0xf101), sha2-256-trunc254-padded
+// multihash (0x1012) of 32 bytes
+const CidPrefix = "\x01" + // CIDv1
+	"\x81\xe2\x03" + // 0xF101
+	"\x92\x20" + // 0x1012
+	"\x20" // 32 bytes of 254sha256
+
+// PaddedPieceSize returns the size of the smallest piece able to hold
+// payloadSize bytes: the next power of two of the fr32-expanded payload
+func PaddedPieceSize(payloadSize uint64) uint64 {
+	expanded := (payloadSize + 126) / 127 * 128
+	if expanded <= 128 {
+		return 128
+	}
+	return 1 << uint(bits.Len64(expanded-1))
+}
+
+// checkMinPayload rejects payloads too small to commit to
+func checkMinPayload(payloadSize uint64) error {
+	if payloadSize < 127 {
+		// https://github.com/filecoin-project/rust-fil-proofs/issues/1231
+		return errors.New("minimum input of 127 bytes required for commP calculation")
+	}
+	return nil
+}
+
 type state struct {
 	shortChunkSeen bool
 	payloadSize    uint64
-	layerQueues    []chan hashTaskResult
-	resultCommP    chan []byte
+	pending        [][]byte // pending[level] holds the nodes not yet paired up, starting at an even index
+	treeLayers     [][]byte // only populated with retainTree
 }
 
 type commpCollector struct {
 	sync.Mutex
 	state
-	fr32WorkBuf       []byte
-	stackedNulPadding [][]byte
-	globalShutdown    <-chan struct{}
+	fr32WorkBuf      []byte
+	retainTree       bool
+	treeBaseLevel    int
+	declaredSize     uint64 // 0 unless Config.PaddedPieceSize is set
+	prePadded        bool
+	lastTree         *Tree
+	flushErr         error         // why the last FlushState() returned no root
+	jobQueue         chan *hashJob // nil when hashing synchronously
+	inlineHasher     *nodeHasher
+	globalShutdown   <-chan struct{}
+	globalShutdownWG *sync.WaitGroup
+}
+
+// stackedNulPadding[i] is the commitment of an all-zero subtree of 32*2^i bytes
+var stackedNulPadding = make([][]byte, maxLayers)
+
+func init() {
+	// initialize the nul padding stack (cheap to do upfront)
+	for i := range stackedNulPadding {
+		if i == 0 {
+			stackedNulPadding[0] = make([]byte, 32)
+		} else {
+			// yes, twice
+			stackedNulPadding[i] = Hash254(stackedNulPadding[i-1], stackedNulPadding[i-1])
+		}
+	}
+}
+
+// Hash254 returns the commitment of a tree node given the commitments of its
+// two children
+func Hash254(left, right []byte) []byte {
+	h := sha256simd.New()
+	h.Write(left)
+	h.Write(right)
+	d := h.Sum(make([]byte, 0, 32))
+	d[31] &= 0x3F
+	return d
+}
+
+// ZeroPieceCommitment returns the commitment of an all-zero padded piece of
+// the given size, or nil if the size is not a power of two between 32 bytes
+// and the largest supported piece
+func ZeroPieceCommitment(paddedPieceSize uint64) []byte {
+	if paddedPieceSize < 32 || paddedPieceSize&(paddedPieceSize-1) != 0 {
+		return nil
+	}
+	layer := bits.TrailingZeros64(paddedPieceSize) - 5
+	if layer >= len(stackedNulPadding) {
+		return nil
+	}
+	return stackedNulPadding[layer]
+}
+
+// PadCommP returns the commitment of a piece of paddedPieceSize bytes, whose
+// leading subtree of subtreeSize bytes has the given commitment and the rest
+// is zero padding. The sizes must be powers of two with subtreeSize not
+// exceeding paddedPieceSize.
+func PadCommP(commP []byte, subtreeSize, paddedPieceSize uint64) []byte {
+	for level := rootLevel(subtreeSize); level < rootLevel(paddedPieceSize); level++ {
+		commP = Hash254(commP, stackedNulPadding[level])
+	}
+	return commP
+}
+
+// Config of the fil-commP collector
+type Config struct {
+	// Retain the tree of each stream, to be retrieved via TakeTree() after
+	// the stream is flushed
+	RetainTree bool
+	// The lowest level retained with RetainTree: 0 retains the leaves and
+	// requires memory of about twice the padded piece size, every level up
+	// halves that
+	TreeBaseLevel int
+	// Compute the commitment of a piece of this padded size instead of the
+	// smallest one able to hold the payload, as if the payload was followed
+	// by zeroes. 0 selects the natural size. Payloads not fitting the piece
+	// are rejected.
+	PaddedPieceSize uint64
+	// Treat the stream as already fr32-padded, as found in unsealed sectors:
+	// 128 byte quanta hashed directly into the tree, with every 32 byte leaf
+	// validated to carry a zero 2-bit shim. The reported payload size is the
+	// one of the unpadded equivalent, which is also the payload a retained
+	// tree expects to be attached.
+	PrePadded bool
 }
 
-type hashTaskResult []byte
+// RequiredChunkSize returns the size of the fixed-size chunks the collector
+// must be fed with
+func (cfg Config) RequiredChunkSize() int {
+	if cfg.PrePadded {
+		return PaddedStrideSize
+	}
+	return StrideSize
+}
+
+func (Config) Name() string { return "fil-commP" }
+
+func (cfg Config) NewInstance(dgrCfg *dgrcollector.DaggerConfig) (_ dgrcollector.Collector, initErrs []string) {
+
+	if dgrCfg.NextCollector != nil || dgrCfg.ChainPosition != 1 {
+		initErrs = append(initErrs, "collector must be used standalone, can not be mixed with others")
+	}
+
+	if cfg.TreeBaseLevel < 0 || cfg.TreeBaseLevel > maxLayers {
+		initErrs = append(initErrs, fmt.Sprintf("tree base level %d out of range [0:%d]", cfg.TreeBaseLevel, maxLayers))
+	} else if cfg.TreeBaseLevel > 0 && !cfg.RetainTree {
+		initErrs = append(initErrs, "tree base level is only meaningful together with RetainTree")
+	}
+
+	if cfg.PaddedPieceSize != 0 && (cfg.PaddedPieceSize < 128 ||
+		cfg.PaddedPieceSize > MaxPiecePayload/127*128 ||
+		cfg.PaddedPieceSize&(cfg.PaddedPieceSize-1) != 0) {
+		initErrs = append(initErrs, fmt.Sprintf(
+			"declared padded piece size %d is not a power of two within [128:%d]",
+			cfg.PaddedPieceSize, MaxPiecePayload/127*128,
+		))
+	}
+
+	if len(initErrs) > 0 {
+		return
+	}
+
+	// Initialize collector
+	cp := &commpCollector{
+		fr32WorkBuf:      make([]byte, cfg.RequiredChunkSize()),
+		retainTree:       cfg.RetainTree,
+		treeBaseLevel:    cfg.TreeBaseLevel,
+		declaredSize:     cfg.PaddedPieceSize,
+		prePadded:        cfg.PrePadded,
+		globalShutdown:   dgrCfg.ShutdownSemaphore,
+		globalShutdownWG: dgrCfg.ShutdownWaitGroup,
+		inlineHasher:     newNodeHasher(),
+	}
+
+	// 0 hashers means everything is hashed synchronously by the appending goroutine
+	if dgrCfg.AsyncHashersCount > 0 {
+		cp.startHashers(dgrCfg.AsyncHashersCount)
+	}
+
+	// Initialize state
+	cp.reset()
+
+	return cp, initErrs
+}
 
 func (*commpCollector) AppendBlock(*dgrblock.Header) error {
 	return errors.New("unexpected invocation of commpCollector.AppendBlock()")
@@ -40,111 +209,146 @@ func (*commpCollector) AppendBlock(*dgrblock.Header) error {
 func (cp *commpCollector) FlushState() *dgrblock.Header {
 	defer cp.reset()
 
-	// This is how we signal to the bottom of the stack that we are done
-	// which in turn collapses the rest all the way to cp.resultCommP
-	close(cp.layerQueues[0])
+	// nothing to commit to
+	if cp.payloadSize == 0 {
+		return nil
+	}
+
+	pieceSize := cp.pieceSize()
 
-	// cid := append(
-	// 	make([]byte, 0, 7+32),
-	// 	"\x01"+ // cid V1
-	// 		"\x81\xe2\x03"+ // 0xF101
-	// 		"\x92\x20"+ // 0x1012
-	// 		"\x20"..., // 32 bytes of 254sha256
-	// )
+	// pad and pair up every level all the way to the root: past the root of
+	// the natural piece this folds in stackedNulPadding of the declared one
+	root := rootLevel(pieceSize)
+	for level := 2; level < root; level++ {
+		if len(cp.pending[level])%64 != 0 {
+			cp.pending[level] = append(cp.pending[level], stackedNulPadding[level]...)
+		}
+		if err := cp.pairUp(level); err != nil {
+			cp.flushErr = err
+			return nil
+		}
+	}
+	commP := cp.pending[root]
 
-	// cid = append(cid, <-cp.resultCommP...)
+	cid := append(
+		make([]byte, 0, len(CidPrefix)+32),
+		CidPrefix...,
+	)
+	cid = append(cid, commP...)
+
+	if cp.retainTree {
+		base := cp.treeBaseLevel
+		if base > root {
+			// a small piece: the root is all there is to retain
+			base = root
+			cp.treeLayers[root] = append([]byte{}, commP...)
+		}
+		cp.lastTree = &Tree{
+			payloadSize: cp.payloadSize,
+			baseLevel:   base,
+			layers:      cp.treeLayers[base : root+1],
+		}
+	}
 
 	return dgrblock.WrapCid(
-		<-cp.resultCommP,
+		cid,
 		0,
-		uint64(
-			math.Pow(
-				2,
-				math.Ceil(
-					math.Log2(
-						float64(cp.payloadSize)/127,
-					),
-				)+7,
-			),
-		),
+		pieceSize,
 		cp.payloadSize,
 	)
 }
 
-func (cp *commpCollector) hash254Into(out chan<- hashTaskResult, data ...[]byte) {
-
-	h := sha256simd.New()
-	for i := range data {
-		h.Write(data[i])
+// pieceSize returns the padded size of the piece of the current stream
+func (cp *commpCollector) pieceSize() uint64 {
+	if cp.declaredSize != 0 {
+		return cp.declaredSize
 	}
-	d := h.Sum(data[0][:0]) // perfectly fine to reuse-reduce-recycle
-	d[31] &= 0x3F
+	return PaddedPieceSize(cp.payloadSize)
+}
+
+func (cp *commpCollector) Reset() {
+	cp.lastTree = nil
+	cp.flushErr = nil
+	cp.reset()
+}
+
+// TakeFlushError returns the error which prevented the most recent
+// FlushState() from producing a root, if any. The FlushState() signature
+// shared by all collectors has no room for it.
+func (cp *commpCollector) TakeFlushError() error {
+	err := cp.flushErr
+	cp.flushErr = nil
+	return err
+}
 
-	out <- d
+// TakeTree returns the tree of the most recently flushed stream, or nil if
+// the collector is not configured with RetainTree. The collector does not
+// keep a reference to the returned tree.
+func (cp *commpCollector) TakeTree() *Tree {
+	t := cp.lastTree
+	cp.lastTree = nil
+	return t
 }
 
 func (cp *commpCollector) reset() {
 	// allocate a new state - GCing everything prior
 	cp.state = state{
-		layerQueues: make([]chan hashTaskResult, maxLayers),
-		resultCommP: make(chan []byte, 1),
+		pending: make([][]byte, maxLayers+1),
+	}
+	if cp.retainTree {
+		cp.treeLayers = make([][]byte, maxLayers+1)
 	}
-
-	cp.layerQueues[0] = make(chan hashTaskResult, 1024) // SANCHECK: too much? too little?
-	cp.addLayer(0)
 }
 
-func (cp *commpCollector) addLayer(myIdx int) {
-	// the next layer channel, which we might *not* use
-	cp.layerQueues[myIdx+1] = make(chan hashTaskResult, 1024) // SANCHECK: too much? too little?
-
-	go func() {
-		var chunkHold hashTaskResult
-
-		for {
-
-			select {
-			case <-cp.globalShutdown:
-				return
-			case chunk, queueIsOpen := <-cp.layerQueues[myIdx]:
+// appendNodes adds freshly computed nodes to a level
+func (cp *commpCollector) appendNodes(level int, nodes []byte) {
+	cp.pending[level] = append(cp.pending[level], nodes...)
+	if cp.retainTree && level >= cp.treeBaseLevel {
+		cp.treeLayers[level] = append(cp.treeLayers[level], nodes...)
+	}
+}
 
-				// the dream is collapsing
-				if !queueIsOpen {
+// validatePadded checks that padded consists of whole 128 byte quanta of
+// valid fr32 leaves, i.e. that the top 2 bits of every 32 byte leaf are zero
+func validatePadded(padded []byte, streamOffset uint64) error {
 
-					// I am last
-					if cp.layerQueues[myIdx+2] == nil {
-						cp.resultCommP <- chunkHold
-						return
-					}
+	if tail := len(padded) % 128; tail != 0 {
+		return fmt.Errorf(
+			"padded input ends with a partial quantum: %d bytes past offset %d",
+			tail, streamOffset+uint64(len(padded)-tail),
+		)
+	}
 
-					if chunkHold != nil {
-						cp.hash254Into(
-							cp.layerQueues[myIdx+1],
-							chunkHold,
-							cp.stackedNulPadding[myIdx+1], // stackedNulPadding is one longer than the main queue
-						)
-					}
+	for i := 31; i < len(padded); i += 32 {
+		if padded[i] > 0x3F {
+			leafOffset := streamOffset + uint64(i-31)
+			return fmt.Errorf(
+				"invalid fr32 shim in the leaf at offset %d (leaf #%d): its top byte at offset %d is 0x%02X, exceeding 0x3F",
+				leafOffset, leafOffset/32, leafOffset+31, padded[i],
+			)
+		}
+	}
 
-					// signal the next in line that they are done too
-					close(cp.layerQueues[myIdx+1])
-					return
-				}
+	return nil
+}
 
-				if chunkHold == nil {
-					chunkHold = chunk
-				} else {
+// pairUp hashes every complete pair of pending nodes on a level into the
+// level above, leaving at most one node pending
+func (cp *commpCollector) pairUp(level int) error {
+	p := cp.pending[level]
+	if len(p) < 64 {
+		return nil
+	}
 
-					// I am last right now
-					if cp.layerQueues[myIdx+2] == nil {
-						cp.addLayer(myIdx + 1)
-					}
+	paired := len(p) / 64 * 64
+	parents, err := cp.hashPairs(p[:paired], level)
+	if err != nil {
+		return err
+	}
 
-					cp.hash254Into(cp.layerQueues[myIdx+1], chunkHold, chunk)
-					chunkHold = nil
-				}
-			}
-		}
-	}()
+	cp.pending[level] = append(p[:0:0], p[paired:]...)
+	cp.appendNodes(level+1, parents)
+	return nil
 }
 
 func (cp *commpCollector) AppendData(ds dgrblock.DataSource) (*dgrblock.Header, error) {
@@ -154,75 +358,57 @@ func (cp *commpCollector) AppendData(ds dgrblock.DataSource) (*dgrblock.Header,
 	}
 
 	cp.fr32WorkBuf = ds.Content.AppendTo(cp.fr32WorkBuf[:0])
-	cp.payloadSize += uint64(ds.Size)
-	rem := cp.payloadSize % 127
-	if rem != 0 {
-
-		if cp.payloadSize < 127 {
-			// https://github.com/filecoin-project/rust-fil-proofs/issues/1231
-			return nil, errors.New("minimum input of 127 bytes required for commP calculation")
-		}
-
-		cp.shortChunkSeen = true
-		cp.fr32WorkBuf = append(cp.fr32WorkBuf, make([]byte, 127-rem)...)
-	}
-
-	for wbufIdx := 0; wbufIdx < len(cp.fr32WorkBuf); wbufIdx += 127 {
-
-		// holds this round's shifts of the original 127 bytes plus the 6 bit overflow
-		// at the end of the expansion cycle
-		expansion := make([]byte, 128)
 
-		if cp.payloadSize > MaxPiecePayload {
-			return nil, fmt.Errorf("maximum proving tree payload size of %d bytes exceeded", MaxPiecePayload)
+	if cp.prePadded {
+		// the stream offset of the chunk, preceded exclusively by whole quanta
+		if err := validatePadded(cp.fr32WorkBuf, cp.payloadSize/127*128); err != nil {
+			return nil, err
 		}
+		cp.payloadSize += uint64(ds.Size) / 128 * 127
+	} else {
+		cp.payloadSize += uint64(ds.Size)
+		if rem := cp.payloadSize % 127; rem != 0 {
 
-		window := cp.fr32WorkBuf[wbufIdx : wbufIdx+127 : wbufIdx+127]
-
-		// Cycle over four(4) 31-byte groups, leaving 1 byte in between:
-		// 31 + 1 + 31 + 1 + 31 + 1 + 31 = 127
-
-		// First 31 bytes + 6 bits are taken as-is (trimmed later)
-		// Note that copying them into the expansion buffer is not strictly
-		// necessary: one could feed the range to the hasher directly. However
-		// there are significant optimizations to be had when feeding exactly 64
-		// bytes at a time to the sha256 implementation, thus keeping the copy()
-		copy(expansion, window[:32])
-
-		// first 2-bit "shim" forced into the otherwise identical bitstream
-		expansion[31] &= 0x3F
-
-		// simplify pointer math
-		windowPlus1, expansionPlus1 := window[1:], expansion[1:]
+			if err := checkMinPayload(cp.payloadSize); err != nil {
+				return nil, err
+			}
 
-		//  In: {{ C[7] C[6] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
-		// Out:                 X[5] X[4] X[3] X[2] X[1] X[0] C[7] C[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] X[7] X[6] Z[5] Z[4] Z[3]...
-		for i := 31; i < 63; i++ {
-			expansionPlus1[i] = windowPlus1[i]<<2 | window[i]>>6
+			cp.shortChunkSeen = true
+			cp.fr32WorkBuf = append(cp.fr32WorkBuf, make([]byte, 127-rem)...)
 		}
+	}
 
-		// next 2-bit shim
-		expansion[63] &= 0x3F
-
-		//  In: {{ C[7] C[6] C[5] C[4] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
-		// Out:                           X[3] X[2] X[1] X[0] C[7] C[6] C[5] C[4] Y[3] Y[2] Y[1] Y[0] X[7] X[6] X[5] X[4] Z[3] Z[2] Z[1]...
-		for i := 63; i < 95; i++ {
-			expansionPlus1[i] = windowPlus1[i]<<4 | window[i]>>4
-		}
+	if cp.payloadSize > MaxPiecePayload {
+		return nil, fmt.Errorf("maximum proving tree payload size of %d bytes exceeded", MaxPiecePayload)
+	}
+	if cp.declaredSize != 0 && PaddedPieceSize(cp.payloadSize) > cp.declaredSize {
+		return nil, fmt.Errorf(
+			"payload exceeds the %d bytes fitting the declared padded piece size of %d bytes",
+			cp.declaredSize/128*127, cp.declaredSize,
+		)
+	}
 
-		// next 2-bit shim
-		expansion[95] &= 0x3F
+	leaves, level1, level2, err := cp.hashQuanta(
+		cp.fr32WorkBuf,
+		cp.retainTree && cp.treeBaseLevel == 0,
+		cp.retainTree && cp.treeBaseLevel <= 1,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if leaves != nil {
+		cp.treeLayers[0] = append(cp.treeLayers[0], leaves...)
+	}
+	if level1 != nil {
+		cp.treeLayers[1] = append(cp.treeLayers[1], level1...)
+	}
+	cp.appendNodes(2, level2)
 
-		//  In: {{ C[7] C[6] C[5] C[4] C[3] C[2] }} X[7] X[6] X[5] X[4] X[3] X[2] X[1] X[0] Y[7] Y[6] Y[5] Y[4] Y[3] Y[2] Y[1] Y[0] Z[7] Z[6] Z[5]...
-		// Out:                                     X[1] X[0] C[7] C[6] C[5] C[4] C[3] C[2] Y[1] Y[0] X[7] X[6] X[5] X[4] X[3] X[2] Z[1] Z[0] Y[7]...
-		for i := 95; i < 126; i++ {
-			expansionPlus1[i] = windowPlus1[i]<<6 | window[i]>>2
+	// fold up whatever is complete, the rest waits for more data or the flush
+	for level := 2; level < maxLayers && len(cp.pending[level]) >= 64; level++ {
+		if err := cp.pairUp(level); err != nil {
+			return nil, err
 		}
-		// the final 6 bit remainder is exactly the value of the last expanded byte
-		expansion[127] = window[126] >> 2
-
-		cp.hash254Into(cp.layerQueues[0], expansion[:64])
-		cp.hash254Into(cp.layerQueues[0], expansion[64:])
 	}
 
 	return nil, nil
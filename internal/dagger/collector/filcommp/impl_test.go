@@ -0,0 +1,49 @@
+package filcommp
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ribasushi/fil-discover-check/chunker"
+	dgrblock "github.com/ribasushi/fil-discover-check/internal/dagger/block"
+	dgrcollector "github.com/ribasushi/fil-discover-check/internal/dagger/collector"
+	"github.com/ribasushi/fil-discover-check/internal/zcpstring"
+)
+
+func TestFlushStateReportsShutdown(t *testing.T) {
+
+	shutdown := make(chan struct{})
+	var wg sync.WaitGroup
+	c, initErrs := Config{}.NewInstance(&dgrcollector.DaggerConfig{
+		ChainPosition:     1,
+		AsyncHashersCount: 1,
+		ShutdownSemaphore: shutdown,
+		ShutdownWaitGroup: &wg,
+	})
+	if len(initErrs) > 0 {
+		t.Fatal(initErrs)
+	}
+	cp := c.(*commpCollector)
+
+	// 3 quanta leave an unpaired level 2 node, which FlushState() must hash
+	payload := make([]byte, 3*127)
+	if _, err := cp.AppendData(dgrblock.DataSource{
+		Chunk:   chunker.Chunk{Size: len(payload)},
+		Content: zcpstring.WrapSlice(payload),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	close(shutdown)
+	wg.Wait()
+
+	if root := cp.FlushState(); root != nil {
+		t.Fatal("FlushState() returned a root despite the hashers being shut down")
+	}
+	if err := cp.TakeFlushError(); err != errShutdown {
+		t.Fatalf("expected %q, got %v", errShutdown, err)
+	}
+	if err := cp.TakeFlushError(); err != nil {
+		t.Fatalf("flush error not cleared after being taken: %s", err)
+	}
+}
@@ -0,0 +1,222 @@
+package filcommp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// SANCHECK: segments smaller than ~1MiB of payload are not worth a worker
+const minSegmentQuanta = 1 << 13
+
+// amount of quanta read from the payload in one go within a segment
+const readQuanta = 1 << 13
+
+type segmentResult struct {
+	index   uint64
+	root    []byte
+	payload int64
+	err     error
+}
+
+// ReaderAtCommP computes the commP of the first size bytes of r. The fr32
+// expanded payload is split into power-of-two-aligned segments, each hashed
+// into a subtree by one of workers goroutines, and the subtree roots are then
+// merged into the root a sequential stream of the same payload arrives at.
+// segmentDone, if not nil, is invoked from the calling goroutine with the
+// payload size of every completed segment.
+func ReaderAtCommP(ctx context.Context, r io.ReaderAt, size int64, workers int, segmentDone func(payloadBytes int64)) ([]byte, error) {
+
+	if err := checkMinPayload(uint64(size)); err != nil {
+		return nil, err
+	}
+	if uint64(size) > MaxPiecePayload {
+		return nil, fmt.Errorf("maximum proving tree payload size of %d bytes exceeded", MaxPiecePayload)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	totalQuanta := (uint64(size) + 126) / 127
+
+	// aim for several segments per worker, to even out the stragglers
+	segQuanta := uint64(1) << uint(bits.Len64((totalQuanta+uint64(workers)*4-1)/(uint64(workers)*4)-1))
+	if segQuanta < minSegmentQuanta {
+		segQuanta = minSegmentQuanta
+	}
+	if pieceQuanta := PaddedPieceSize(uint64(size)) / 128; segQuanta > pieceQuanta {
+		segQuanta = pieceQuanta
+	}
+	segLevel := bits.TrailingZeros64(segQuanta) + 2
+	segCount := (totalQuanta + segQuanta - 1) / segQuanta
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	segments := make(chan uint64)
+	results := make(chan segmentResult, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sh := newSubtreeHasher(segLevel)
+			for idx := range segments {
+				res := segmentResult{index: idx}
+				res.root, res.payload, res.err = sh.segmentRoot(ctx, r, size, idx*segQuanta*127, segQuanta)
+				results <- res
+			}
+		}()
+	}
+
+	go func() {
+		defer close(segments)
+		for idx := uint64(0); idx < segCount; idx++ {
+			select {
+			case segments <- idx:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	roots := make([][]byte, segCount)
+	var firstErr error
+	for res := range results {
+		if res.err != nil {
+			if firstErr == nil {
+				firstErr = res.err
+				cancel()
+			}
+			continue
+		}
+		roots[res.index] = res.root
+		if segmentDone != nil && firstErr == nil {
+			segmentDone(res.payload)
+		}
+	}
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	// merge the segment roots, completing the layers with nul padding
+	for level := segLevel; level < rootLevel(PaddedPieceSize(uint64(size))); level++ {
+		if len(roots)%2 != 0 {
+			roots = append(roots, stackedNulPadding[level])
+		}
+		for i := 0; i < len(roots)/2; i++ {
+			roots[i] = Hash254(roots[2*i], roots[2*i+1])
+		}
+		roots = roots[:len(roots)/2]
+	}
+
+	return roots[0], nil
+}
+
+// nodeStack holds the pending left nodes of a tree being built from its
+// leftmost level 2 nodes up. It is a plain value: copies are independent.
+type nodeStack struct {
+	nodes [maxLayers + 1][32]byte
+	held  [maxLayers + 1]bool // whether nodes[level] is pending
+}
+
+// push places a node of the given level, merging it with every pending left
+// sibling on the way up. The contents of node are overwritten.
+func (ns *nodeStack) push(nh *nodeHasher, node []byte, level int) {
+	for ns.held[level] {
+		nh.parentInto(node, ns.nodes[level][:], node, level)
+		ns.held[level] = false
+		level++
+	}
+	copy(ns.nodes[level][:], node)
+	ns.held[level] = true
+}
+
+// complete pairs every pending node with nul padding, from the lowest one up,
+// and returns the resulting node of topLevel
+func (ns *nodeStack) complete(nh *nodeHasher, topLevel int) []byte {
+	var n [32]byte
+	for level := 2; level < topLevel; level++ {
+		if ns.held[level] {
+			copy(n[:], stackedNulPadding[level])
+			ns.push(nh, n[:], level)
+		}
+	}
+	return ns.nodes[topLevel][:]
+}
+
+// subtreeHasher is the single-goroutine state of a segment worker
+type subtreeHasher struct {
+	*nodeHasher
+	nodeStack
+	topLevel int
+	readBuf  []byte
+}
+
+func newSubtreeHasher(topLevel int) *subtreeHasher {
+	return &subtreeHasher{
+		nodeHasher: newNodeHasher(),
+		topLevel:   topLevel,
+		readBuf:    make([]byte, readQuanta*127),
+	}
+}
+
+// segmentRoot hashes the segment of segQuanta quanta starting at the payload
+// offset start, returning its root and the amount of payload it covered
+func (sh *subtreeHasher) segmentRoot(ctx context.Context, r io.ReaderAt, size int64, start, segQuanta uint64) ([]byte, int64, error) {
+
+	sh.nodeStack = nodeStack{}
+
+	end := start + segQuanta*127
+	if end > uint64(size) {
+		end = uint64(size)
+	}
+
+	var n2 [32]byte
+	for offset := start; offset < end; offset += readQuanta * 127 {
+
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		chunkEnd := offset + readQuanta*127
+		if chunkEnd > end {
+			chunkEnd = end
+		}
+		buf := sh.readBuf[:chunkEnd-offset]
+		if n, err := r.ReadAt(buf, int64(offset)); err != nil && !(err == io.EOF && n == len(buf)) {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, 0, fmt.Errorf("reading payload at offset %d failed: %s", offset, err)
+		}
+
+		// the very last quantum of the payload is zero-filled
+		if rem := len(buf) % 127; rem != 0 {
+			buf = sh.readBuf[:len(buf)+127-rem]
+			for i := len(buf) - 127 + rem; i < len(buf); i++ {
+				buf[i] = 0
+			}
+		}
+
+		for q := 0; q < len(buf); q += 127 {
+			sh.quantumNode(n2[:], buf[q:q+127], nil, nil)
+			sh.push(sh.nodeHasher, n2[:], 2)
+		}
+	}
+
+	// a partial segment is completed with nul padding
+	root := append([]byte{}, sh.complete(sh.nodeHasher, sh.topLevel)...)
+	return root, int64(end - start), nil
+}
@@ -0,0 +1,546 @@
+package filcommp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/ribasushi/fil-discover-check/fr32"
+)
+
+// Tree is the piece commitment tree of a stream, as retained by a collector
+// configured with RetainTree, or as loaded from a sidecar via LoadTree().
+//
+// Level 0 holds the 32 byte fr32 leaves, the topmost level holds the root
+// alone. Only the levels from BaseLevel() up are stored, and nodes consisting
+// entirely of the zero padding past the end of the payload are omitted. Nodes
+// below the base level are recomputed from the payload supplied via
+// AttachPayload().
+type Tree struct {
+	payloadSize uint64
+	baseLevel   int
+	layers      [][]byte // layers[i] holds the nodes of level baseLevel+i
+	payload     io.ReaderAt
+}
+
+// Proof is an inclusion proof of a contiguous run of leaves within a piece
+type Proof struct {
+	// Payload bytes preceding and following the proven range within its
+	// first and last 127 byte fr32 quantum: only set by ProvePayloadRange()
+	Head []byte
+	Tail []byte
+
+	// Sibling commitments necessary to fold the leaves up to the root, in the
+	// order they are consumed: bottom-up, and within a level left before right
+	Siblings [][]byte
+}
+
+// Sidecar layout, all integers big-endian: the magic, payload size (uint64),
+// base level (uint8) and layer count (uint8), followed by every stored layer
+// bottom-up as a node count (uint64) and the concatenated nodes
+const treeMagic = "fcpTREE1"
+
+func rootLevel(paddedPieceSize uint64) int {
+	return bits.TrailingZeros64(paddedPieceSize) - 5
+}
+
+// amount of stored (non-padding) nodes on a given level
+func storedNodes(payloadSize uint64, level int) uint64 {
+	leaves := (payloadSize + 126) / 127 * 4
+	return (leaves + (1 << uint(level)) - 1) >> uint(level)
+}
+
+// PayloadSize returns the size of the unpadded stream the tree was built from
+func (t *Tree) PayloadSize() uint64 { return t.payloadSize }
+
+// PaddedPieceSize returns the size of the piece the tree spans, which exceeds
+// PaddedPieceSize(PayloadSize()) when the piece size was declared upfront
+func (t *Tree) PaddedPieceSize() uint64 { return 32 << uint(t.baseLevel+len(t.layers)-1) }
+
+// BaseLevel returns the lowest stored level of the tree
+func (t *Tree) BaseLevel() int { return t.baseLevel }
+
+// CommP returns the 32 byte root of the tree
+func (t *Tree) CommP() []byte { return t.layers[len(t.layers)-1][:32:32] }
+
+// AttachPayload supplies the unpadded payload the tree was built from. It is
+// required for proofs and leaves whenever the base level is above 0, and for
+// RootWithReplacedRange(). Only the ranges involved are read.
+func (t *Tree) AttachPayload(payload io.ReaderAt) { t.payload = payload }
+
+// Leaf returns the leaf with the given index, which may lie within the zero
+// padding of the piece
+func (t *Tree) Leaf(index uint64) ([]byte, error) {
+	if index >= t.PaddedPieceSize()/32 {
+		return nil, fmt.Errorf("leaf %d out of range of a %d byte piece", index, t.PaddedPieceSize())
+	}
+	return t.node(0, index)
+}
+
+func (t *Tree) node(level int, index uint64) ([]byte, error) {
+	if index<<uint(level) >= storedNodes(t.payloadSize, 0) {
+		return stackedNulPadding[level], nil
+	}
+	if level < t.baseLevel {
+		nodes, err := t.computeNodes(level, index, index+1, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		return nodes[0], nil
+	}
+	l := t.layers[level-t.baseLevel]
+	return l[index*32 : index*32+32 : index*32+32], nil
+}
+
+// payloadQuanta returns the payload covering the fr32 quanta [first:end),
+// zero-filled past the end of the payload
+func (t *Tree) payloadQuanta(first, end uint64) ([]byte, error) {
+
+	buf := make([]byte, (end-first)*127)
+
+	if t.baseLevel == 0 {
+		leaves := t.layers[0]
+		for q := first; q < end && q < uint64(len(leaves))/128; q++ {
+			fr32.UnpadQuantum(buf[(q-first)*127:], leaves[q*128:])
+		}
+		return buf, nil
+	}
+
+	if t.payload == nil {
+		return nil, fmt.Errorf("payload must be attached to access nodes below the base level %d", t.baseLevel)
+	}
+
+	readEnd := end * 127
+	if readEnd > t.payloadSize {
+		readEnd = t.payloadSize
+	}
+	if readEnd > first*127 {
+		if n, err := t.payload.ReadAt(buf[:readEnd-first*127], int64(first*127)); err != nil && !(err == io.EOF && uint64(n) == readEnd-first*127) {
+			return nil, fmt.Errorf("reading payload at offset %d failed: %s", first*127, err)
+		}
+	}
+	return buf, nil
+}
+
+// computeNodes derives the nodes [first:end) of a level from the payload,
+// optionally with replacement placed at the payload offset replaceAt
+func (t *Tree) computeNodes(level int, first, end uint64, replaceAt uint64, replacement []byte) ([][]byte, error) {
+
+	leafFirst, leafEnd := first<<uint(level), end<<uint(level)
+	quantFirst, quantEnd := leafFirst/4, (leafEnd+3)/4
+
+	payload, err := t.payloadQuanta(quantFirst, quantEnd)
+	if err != nil {
+		return nil, err
+	}
+	if replacement != nil {
+		copy(payload[replaceAt-quantFirst*127:], replacement)
+	}
+
+	leaves := make([]byte, (quantEnd-quantFirst)*128)
+	for i := uint64(0); i < quantEnd-quantFirst; i++ {
+		fr32.PadQuantum(leaves[i*128:], payload[i*127:])
+	}
+	leaves = leaves[(leafFirst-quantFirst*4)*32 : (leafEnd-quantFirst*4)*32]
+
+	nodes := make([][]byte, 0, len(leaves)/32)
+	for i := 0; i < len(leaves); i += 32 {
+		nodes = append(nodes, leaves[i:i+32:i+32])
+	}
+	for l := 0; l < level; l++ {
+		for i := 0; i < len(nodes)/2; i++ {
+			nodes[i] = Hash254(nodes[2*i], nodes[2*i+1])
+		}
+		nodes = nodes[:len(nodes)/2]
+	}
+	return nodes, nil
+}
+
+// ProveLeaf returns the inclusion proof of a single leaf
+func (t *Tree) ProveLeaf(index uint64) (*Proof, error) {
+	if index >= t.PaddedPieceSize()/32 {
+		return nil, fmt.Errorf("leaf %d out of range of a %d byte piece", index, t.PaddedPieceSize())
+	}
+	sibs, err := t.siblings(index, index+1)
+	if err != nil {
+		return nil, err
+	}
+	return &Proof{Siblings: sibs}, nil
+}
+
+// ProvePayloadRange returns the inclusion proof of length bytes of the
+// payload starting at offset. The proof covers every fr32 quantum the range
+// touches, carrying the surrounding payload bytes of the first and last
+// quantum, so that the verifier requires nothing besides the range itself.
+func (t *Tree) ProvePayloadRange(offset, length uint64) (*Proof, error) {
+	if err := t.checkRange(offset, length); err != nil {
+		return nil, err
+	}
+
+	firstQuant := offset / 127
+	endQuant := (offset + length + 126) / 127
+
+	tailEnd := endQuant * 127
+	if tailEnd > t.payloadSize {
+		tailEnd = t.payloadSize
+	}
+
+	head, err := t.payloadQuanta(firstQuant, firstQuant+1)
+	if err != nil {
+		return nil, err
+	}
+	tail, err := t.payloadQuanta(endQuant-1, endQuant)
+	if err != nil {
+		return nil, err
+	}
+
+	sibs, err := t.siblings(firstQuant*4, endQuant*4)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Proof{
+		Head:     head[:offset-firstQuant*127],
+		Tail:     tail[(offset+length)-(endQuant-1)*127 : tailEnd-(endQuant-1)*127],
+		Siblings: sibs,
+	}, nil
+}
+
+func (t *Tree) checkRange(offset, length uint64) error {
+	if length == 0 || offset+length < offset || offset+length > t.payloadSize {
+		return fmt.Errorf(
+			"range of %d bytes at offset %d out of bounds of a %d byte payload",
+			length, offset, t.payloadSize,
+		)
+	}
+	return nil
+}
+
+func (t *Tree) siblings(first, end uint64) (sibs [][]byte, err error) {
+	for level := 0; level < t.baseLevel+len(t.layers)-1; level++ {
+		if first&1 == 1 {
+			first--
+			s, err := t.node(level, first)
+			if err != nil {
+				return nil, err
+			}
+			sibs = append(sibs, s)
+		}
+		if end&1 == 1 {
+			s, err := t.node(level, end)
+			if err != nil {
+				return nil, err
+			}
+			sibs = append(sibs, s)
+			end++
+		}
+		first /= 2
+		end /= 2
+	}
+	return sibs, nil
+}
+
+// RootWithReplacedRange returns the root the piece would have if the payload
+// at offset was replaced by data of the same length. Only the base level
+// subtrees covering the range are recomputed, from the attached payload or
+// the stored leaves, the rest of the tree is reused as-is.
+func (t *Tree) RootWithReplacedRange(offset uint64, data []byte) ([]byte, error) {
+	if err := t.checkRange(offset, uint64(len(data))); err != nil {
+		return nil, err
+	}
+
+	first := offset / 127 * 4 >> uint(t.baseLevel)
+	end := ((offset+uint64(len(data))+126)/127*4 + (1 << uint(t.baseLevel)) - 1) >> uint(t.baseLevel)
+
+	nodes, err := t.computeNodes(t.baseLevel, first, end, offset, data)
+	if err != nil {
+		return nil, err
+	}
+
+	for level := t.baseLevel; level < t.baseLevel+len(t.layers)-1; level++ {
+		if first&1 == 1 {
+			first--
+			s, _ := t.node(level, first) // stored level: can not fail
+			nodes = append([][]byte{s}, nodes...)
+		}
+		if end&1 == 1 {
+			s, _ := t.node(level, end)
+			nodes = append(nodes, s)
+			end++
+		}
+		for i := 0; i < len(nodes)/2; i++ {
+			nodes[i] = Hash254(nodes[2*i], nodes[2*i+1])
+		}
+		nodes = nodes[:len(nodes)/2]
+		first /= 2
+		end /= 2
+	}
+
+	return nodes[0], nil
+}
+
+// WriteTo serializes the stored levels of the tree in the sidecar format
+// understood by LoadTree()
+func (t *Tree) WriteTo(w io.Writer) (int64, error) {
+
+	hdr := make([]byte, 0, len(treeMagic)+8+2)
+	hdr = append(hdr, treeMagic...)
+	hdr = append(hdr, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(hdr[len(treeMagic):], t.payloadSize)
+	hdr = append(hdr, byte(t.baseLevel), byte(len(t.layers)))
+
+	var written int64
+	n, err := w.Write(hdr)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+
+	countBuf := make([]byte, 8)
+	for _, l := range t.layers {
+		binary.BigEndian.PutUint64(countBuf, uint64(len(l)/32))
+		n, err = w.Write(countBuf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		n, err = w.Write(l)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// LoadTree reads a tree previously serialized via Tree.WriteTo(). Every
+// stored level is recomputed from the one below it, thus the root of the
+// returned tree is guaranteed to be derived from its base level.
+func LoadTree(r io.Reader) (*Tree, error) {
+
+	hdr := make([]byte, len(treeMagic)+8+2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("reading tree header failed: %s", err)
+	}
+	if string(hdr[:len(treeMagic)]) != treeMagic {
+		return nil, errors.New("not a commP tree sidecar")
+	}
+
+	t := &Tree{
+		payloadSize: binary.BigEndian.Uint64(hdr[len(treeMagic):]),
+		baseLevel:   int(hdr[len(hdr)-2]),
+	}
+	layerCount := int(hdr[len(hdr)-1])
+
+	if t.payloadSize < 127 || t.payloadSize > MaxPiecePayload {
+		return nil, fmt.Errorf("invalid payload size %d", t.payloadSize)
+	}
+	// the root is above the natural one of the payload for declared piece sizes
+	top := t.baseLevel + layerCount - 1
+	if root := rootLevel(PaddedPieceSize(t.payloadSize)); layerCount == 0 || top < root || top > maxLayers {
+		return nil, fmt.Errorf(
+			"levels %d to %d do not end at or above the root level %d of a %d byte piece",
+			t.baseLevel, top, root, PaddedPieceSize(t.payloadSize),
+		)
+	}
+
+	countBuf := make([]byte, 8)
+	for level := t.baseLevel; level < t.baseLevel+layerCount; level++ {
+		if _, err := io.ReadFull(r, countBuf); err != nil {
+			return nil, fmt.Errorf("reading level %d failed: %s", level, err)
+		}
+		if count, expected := binary.BigEndian.Uint64(countBuf), storedNodes(t.payloadSize, level); count != expected {
+			return nil, fmt.Errorf("level %d holds %d nodes instead of the expected %d", level, count, expected)
+		}
+
+		l, err := readLayer(r, storedNodes(t.payloadSize, level)*32)
+		if err != nil {
+			return nil, fmt.Errorf("reading level %d failed: %s", level, err)
+		}
+		t.layers = append(t.layers, l)
+
+		if level == t.baseLevel {
+			continue
+		}
+		for i := uint64(0); i < uint64(len(l))/32; i++ {
+			left, _ := t.node(level-1, 2*i)
+			right, _ := t.node(level-1, 2*i+1)
+			if !bytes.Equal(Hash254(left, right), l[i*32:i*32+32]) {
+				return nil, fmt.Errorf("node %d of level %d does not match its children", i, level)
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// amount of layer data read from a sidecar in one go
+const layerReadChunk = 1 << 20
+
+// readLayer reads a layer of the given size without trusting the size up
+// front: the buffer grows geometrically from a single chunk, so that a forged
+// header can not trigger an allocation out of proportion to the actual input
+func readLayer(r io.Reader, size uint64) ([]byte, error) {
+
+	l := make([]byte, 0, minU64(size, layerReadChunk))
+	for uint64(len(l)) < size {
+		chunk := minU64(size-uint64(len(l)), layerReadChunk)
+		if uint64(cap(l)-len(l)) < chunk {
+			grown := make([]byte, len(l), minU64(2*uint64(cap(l)), size))
+			copy(grown, l)
+			l = grown
+		}
+		if _, err := io.ReadFull(r, l[len(l):len(l)+int(chunk)]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		l = l[:len(l)+int(chunk)]
+	}
+
+	return l, nil
+}
+
+func minU64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var errNoProof = errors.New("no proof supplied")
+
+// VerifyLeaves checks that the concatenated 32 byte leaves, starting at leaf
+// firstLeaf, are part of the piece of the given size with root commP
+func VerifyLeaves(commP []byte, paddedPieceSize, firstLeaf uint64, leaves []byte, proof *Proof) error {
+
+	if proof == nil {
+		return errNoProof
+	}
+	if paddedPieceSize < 128 || paddedPieceSize&(paddedPieceSize-1) != 0 || rootLevel(paddedPieceSize) > maxLayers {
+		return fmt.Errorf("invalid padded piece size %d", paddedPieceSize)
+	}
+	if len(leaves) == 0 || len(leaves)%32 != 0 {
+		return fmt.Errorf("leaves must be a non-empty multiple of 32 bytes, got %d bytes", len(leaves))
+	}
+
+	first := firstLeaf
+	end := firstLeaf + uint64(len(leaves)/32)
+	if end < first || end > paddedPieceSize/32 {
+		return fmt.Errorf("%d leaves at leaf %d out of range of a %d byte piece", len(leaves)/32, firstLeaf, paddedPieceSize)
+	}
+
+	nodes := make([][]byte, 0, len(leaves)/32+1)
+	for i := 0; i < len(leaves); i += 32 {
+		nodes = append(nodes, leaves[i:i+32:i+32])
+	}
+
+	sibs := proof.Siblings
+	nextSibling := func() ([]byte, error) {
+		if len(sibs) == 0 {
+			return nil, errors.New("proof is missing siblings")
+		}
+		s := sibs[0]
+		sibs = sibs[1:]
+		if len(s) != 32 {
+			return nil, fmt.Errorf("invalid proof sibling of %d bytes", len(s))
+		}
+		return s, nil
+	}
+
+	for level := 0; level < rootLevel(paddedPieceSize); level++ {
+		if first&1 == 1 {
+			s, err := nextSibling()
+			if err != nil {
+				return err
+			}
+			nodes = append([][]byte{s}, nodes...)
+			first--
+		}
+		if end&1 == 1 {
+			s, err := nextSibling()
+			if err != nil {
+				return err
+			}
+			nodes = append(nodes, s)
+			end++
+		}
+
+		for i := 0; i < len(nodes)/2; i++ {
+			nodes[i] = Hash254(nodes[2*i], nodes[2*i+1])
+		}
+		nodes = nodes[:len(nodes)/2]
+		first /= 2
+		end /= 2
+	}
+
+	if len(sibs) != 0 {
+		return fmt.Errorf("proof contains %d unused siblings", len(sibs))
+	}
+	if !bytes.Equal(nodes[0], commP) {
+		return errors.New("leaves do not belong to the piece: root mismatch")
+	}
+	return nil
+}
+
+// VerifyPayloadRange checks that data, found at the given payload offset, is
+// part of the payload of payloadSize bytes committed to by the piece of the
+// given size with root commP. The payload size is required to tell the zero
+// padding following the payload apart from payload bytes.
+func VerifyPayloadRange(commP []byte, paddedPieceSize, payloadSize, offset uint64, data []byte, proof *Proof) error {
+
+	if proof == nil {
+		return errNoProof
+	}
+	if len(data) == 0 {
+		return errors.New("empty payload range")
+	}
+	if payloadSize == 0 || payloadSize > MaxPiecePayload || PaddedPieceSize(payloadSize) > paddedPieceSize {
+		return fmt.Errorf("payload of %d bytes does not fit a %d byte piece", payloadSize, paddedPieceSize)
+	}
+	end := offset + uint64(len(data))
+	if end < offset || end > payloadSize {
+		return fmt.Errorf(
+			"range of %d bytes at offset %d out of bounds of a %d byte payload",
+			len(data), offset, payloadSize,
+		)
+	}
+
+	firstQuant := offset / 127
+	if uint64(len(proof.Head)) != offset-firstQuant*127 {
+		return fmt.Errorf(
+			"proof head of %d bytes does not reach offset %d from its quantum boundary",
+			len(proof.Head), offset,
+		)
+	}
+	tailEnd := (end + 126) / 127 * 127
+	if tailEnd > payloadSize {
+		tailEnd = payloadSize
+	}
+	if uint64(len(proof.Tail)) != tailEnd-end {
+		return fmt.Errorf(
+			"proof tail of %d bytes does not reach offset %d from the end of the range",
+			len(proof.Tail), tailEnd,
+		)
+	}
+
+	quanta := make([]byte, 0, len(proof.Head)+len(data)+len(proof.Tail)+126)
+	quanta = append(quanta, proof.Head...)
+	quanta = append(quanta, data...)
+	quanta = append(quanta, proof.Tail...)
+	if rem := len(quanta) % 127; rem != 0 {
+		quanta = append(quanta, make([]byte, 127-rem)...)
+	}
+
+	leaves := make([]byte, len(quanta)/127*128)
+	for i := 0; i < len(quanta)/127; i++ {
+		fr32.PadQuantum(leaves[i*128:], quanta[i*127:])
+	}
+
+	return VerifyLeaves(commP, paddedPieceSize, firstQuant*4, leaves, proof)
+}
@@ -54,6 +54,16 @@ func SubHelp(description string, optSet *getopt.Set) (sh []string) {
 var maxPlaceholder *regexp.Regexp
 
 func Parse(args []string, optSet *getopt.Set) (argErrs []string) {
+	return parse(args, optSet, false)
+}
+
+// ParseWithParameters is Parse for option sets accepting free-form parameters
+// after the options, available via optSet.Args()
+func ParseWithParameters(args []string, optSet *getopt.Set) (argErrs []string) {
+	return parse(args, optSet, true)
+}
+
+func parse(args []string, optSet *getopt.Set, allowParameters bool) (argErrs []string) {
 
 	if maxPlaceholder == nil {
 		maxPlaceholder = regexp.MustCompile(`\bMaxPayload\b`)
@@ -64,7 +74,7 @@ func Parse(args []string, optSet *getopt.Set) (argErrs []string) {
 	}
 
 	unexpectedArgs := optSet.Args()
-	if len(unexpectedArgs) != 0 {
+	if len(unexpectedArgs) != 0 && !allowParameters {
 		argErrs = append(argErrs, fmt.Sprintf(
 			"unexpected free-form parameter(s): %s...",
 			unexpectedArgs[0],